@@ -0,0 +1,62 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"database/sql"
+	"encoding/pem"
+	"sync"
+
+	"github.com/fiatjaf/litepub"
+)
+
+var actorKeys sync.Map // map[nostr pubkey]*rsa.PrivateKey
+
+// actorKey returns the rsa key of the pub actor that represents a nostr pubkey,
+// it is generated on the first time and stored forever.
+func actorKey(pubkey string) (*rsa.PrivateKey, error) {
+	if sk, ok := actorKeys.Load(pubkey); ok {
+		return sk.(*rsa.PrivateKey), nil
+	}
+
+	var pemString string
+	err := pg.Get(&pemString, "SELECT private_key FROM actor_keys WHERE nostr_pubkey = $1", pubkey)
+	if err == sql.ErrNoRows {
+		sk, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return nil, err
+		}
+		pemString = string(pem.EncodeToMemory(&pem.Block{
+			Type:  "RSA PRIVATE KEY",
+			Bytes: x509.MarshalPKCS1PrivateKey(sk),
+		}))
+
+		// if a key was generated concurrently we get that one back instead
+		err = pg.Get(&pemString, `
+            INSERT INTO actor_keys (nostr_pubkey, private_key)
+            VALUES ($1, $2)
+            ON CONFLICT (nostr_pubkey) DO UPDATE SET private_key = actor_keys.private_key
+            RETURNING private_key
+        `, pubkey, pemString)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sk, err := litepub.ParsePrivateKeyFromPEM(pemString)
+	if err != nil {
+		return nil, err
+	}
+
+	actorKeys.Store(pubkey, sk)
+	return sk, nil
+}
+
+func actorPublicKeyPEM(pubkey string) (string, error) {
+	sk, err := actorKey(pubkey)
+	if err != nil {
+		return "", err
+	}
+	return litepub.PublicKeyToPEM(&sk.PublicKey)
+}
@@ -15,14 +15,14 @@ func metadatakey(pk string) string   { return fmt.Sprintf("0:%s", pk) }
 func contactskey(pk string) string   { return fmt.Sprintf("3:%s", pk) }
 
 func cacheEvent(evt nostr.Event) {
-	if evt.Kind != 0 && evt.Kind != 1 && evt.Kind != 3 {
+	if evt.Kind != 0 && evt.Kind != 1 && evt.Kind != 3 && evt.Kind != 6 {
 		log.Warn().Int("kind", evt.Kind).Msg("won't cache event")
 		return
 	}
 
 	j, _ := json.Marshal(evt)
 
-	// notes
+	// notes (and reposts, which go along with them)
 	keys := []string{
 		snotekey(evt.ID),
 		anoteskey(evt.PubKey, evt.ID),
@@ -52,7 +52,10 @@ func cacheEvent(evt nostr.Event) {
 		_, err := pg.Exec(`
             INSERT INTO cache (key, value, time, expiration)
             VALUES ($1, $2, $3, now() + interval '10 days')
-            ON CONFLICT (key) DO UPDATE SET expiration = EXCLUDED.expiration
+            ON CONFLICT (key) DO UPDATE SET
+              value = CASE WHEN cache.time > EXCLUDED.time THEN cache.value ELSE EXCLUDED.value END,
+              time = greatest(cache.time, EXCLUDED.time),
+              expiration = EXCLUDED.expiration
         `, k, j, evt.CreatedAt)
 		if err != nil {
 			log.Warn().Err(err).Interface("evt", evt).Msg("error caching")
@@ -60,47 +63,72 @@ func cacheEvent(evt nostr.Event) {
 	}
 }
 
+// uncacheEvent forgets an event, but only if it is from the given pubkey.
+func uncacheEvent(id string, pubkey string) {
+	if _, err := pg.Exec(`
+        DELETE FROM cache
+        WHERE (key = $1 AND value::jsonb->>'pubkey' = $3) OR key = $2
+    `, snotekey(id), anoteskey(pubkey, id), pubkey); err != nil {
+		log.Warn().Err(err).Str("id", id).Msg("error uncaching")
+	}
+}
+
 func getCachedNote(id string) *nostr.Event {
-	var evt *nostr.Event
+	var evt nostr.Event
 	var j string
 	err := pg.Get(&j, "SELECT value FROM cache WHERE key = $1", snotekey(id))
 	if err != nil && err != sql.ErrNoRows {
 		log.Error().Err(err).Str("id", id).Msg("error getting cached note")
 	}
-	json.Unmarshal([]byte(j), evt)
-	return evt
+	if err := json.Unmarshal([]byte(j), &evt); err != nil {
+		return nil
+	}
+	return &evt
 }
 
 func getCachedMetadata(pubkey string) *nostr.Event {
-	var evt *nostr.Event
+	var evt nostr.Event
 	var j string
 	err := pg.Get(&j, "SELECT value FROM cache WHERE key = $1", metadatakey(pubkey))
 	if err != nil && err != sql.ErrNoRows {
 		log.Error().Err(err).Str("pubkey", pubkey).Msg("error getting cached metadata")
 	}
-	json.Unmarshal([]byte(j), evt)
-	return evt
+	if err := json.Unmarshal([]byte(j), &evt); err != nil {
+		return nil
+	}
+	return &evt
 }
 
 func getCachedContactList(pubkey string) *nostr.Event {
-	var evt *nostr.Event
+	var evt nostr.Event
 	var j string
 	err := pg.Get(&j, "SELECT value FROM cache WHERE key = $1", contactskey(pubkey))
 	if err != nil && err != sql.ErrNoRows {
 		log.Error().Err(err).Str("pubkey", pubkey).Msg("error getting cached contacts")
 	}
-	json.Unmarshal([]byte(j), evt)
-	return evt
+	if err := json.Unmarshal([]byte(j), &evt); err != nil {
+		return nil
+	}
+	return &evt
 }
 
-func getNotesForPubkey(pubkey string) []nostr.Event {
+// getNotesForPubkey returns cached notes and reposts between since and until,
+// newest first, or oldest first when only since is given.
+func getNotesForPubkey(pubkey string, since, until *time.Time, limit int) []nostr.Event {
+	order := "DESC"
+	if since != nil && until == nil {
+		order = "ASC"
+	}
+
 	var js []string
 	err := pg.Select(&js, `
         SELECT value FROM cache
         WHERE key LIKE '1:' || $1 || '%'
-        ORDER BY time DESC
-        LIMIT 100
-    `, pubkey)
+          AND ($2::timestamp IS NULL OR time >= $2)
+          AND ($3::timestamp IS NULL OR time <= $3)
+        ORDER BY time `+order+`
+        LIMIT $4
+    `, pubkey, since, until, limit)
 	if err != nil && err != sql.ErrNoRows {
 		log.Error().Err(err).Str("pubkey", pubkey).Msg("error getting cached notes")
 	}
@@ -0,0 +1,476 @@
+package main
+
+import (
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+	"golang.org/x/exp/slices"
+	"golang.org/x/net/html"
+)
+
+var (
+	htmlWhitespace = regexp.MustCompile(`[ \t\r\n\f]+`)
+	manyNewlines   = regexp.MustCompile(`\n{3,}`)
+)
+
+// nostrContentFromHTML turns the HTML content of a pub note into plain text
+// keeping paragraphs, line breaks and links. mentions are turned into nostr:npub
+// references using the note's Mention tags and the mentioned pubkeys are returned.
+func nostrContentFromHTML(content string, tags []Tag) (string, []string) {
+	var (
+		out       strings.Builder
+		mentioned []string
+		anchor    *htmlAnchor
+		skipping  string // inside <script> or <style>
+		inPre     bool
+	)
+
+	write := func(text string) {
+		if anchor != nil {
+			anchor.text.WriteString(text)
+			return
+		}
+		if !inPre && (out.Len() == 0 || strings.HasSuffix(out.String(), "\n")) {
+			// whitespace at the start of a line is only kept in <pre>
+			text = strings.TrimLeft(text, " ")
+		}
+		out.WriteString(text)
+	}
+	lineBreak := func(n int) {
+		if anchor != nil || out.Len() == 0 {
+			return
+		}
+		current := out.String()
+		for i := len(current) - 1; i >= 0 && current[i] == '\n' && n > 0; i-- {
+			n--
+		}
+		out.WriteString(strings.Repeat("\n", n))
+	}
+
+	z := html.NewTokenizer(strings.NewReader(content))
+tokens:
+	for {
+		tt := z.Next()
+		switch tt {
+		case html.ErrorToken:
+			break tokens
+		case html.TextToken:
+			if skipping != "" {
+				continue
+			}
+			text := string(z.Text())
+			if !inPre {
+				text = htmlWhitespace.ReplaceAllString(text, " ")
+			}
+			write(text)
+			continue
+		case html.StartTagToken, html.EndTagToken, html.SelfClosingTagToken:
+		default:
+			continue
+		}
+
+		rawName, hasAttr := z.TagName()
+		name := string(rawName)
+		closing := tt == html.EndTagToken
+		attrs := make(map[string]string)
+		for hasAttr {
+			var k, v []byte
+			k, v, hasAttr = z.TagAttr()
+			attrs[string(k)] = string(v)
+		}
+
+		if skipping != "" {
+			if closing && name == skipping {
+				skipping = ""
+			}
+			continue
+		}
+
+		switch name {
+		case "script", "style":
+			if !closing {
+				skipping = name
+			}
+		case "br":
+			if anchor != nil {
+				anchor.text.WriteString(" ")
+			} else {
+				out.WriteString("\n")
+			}
+		case "p", "div", "blockquote", "ul", "ol", "h1", "h2", "h3", "h4", "h5", "h6":
+			lineBreak(2)
+		case "pre":
+			lineBreak(2)
+			inPre = !closing
+		case "li":
+			if !closing {
+				lineBreak(1)
+				out.WriteString("- ")
+			}
+		case "a":
+			if !closing {
+				anchor = &htmlAnchor{href: attrs["href"], class: attrs["class"]}
+			} else if anchor != nil {
+				text, pubkey := anchor.render(tags)
+				anchor = nil
+				out.WriteString(text)
+				if pubkey != "" {
+					mentioned = append(mentioned, pubkey)
+				}
+			}
+		}
+	}
+
+	// an unclosed <a>
+	if anchor != nil {
+		text, _ := anchor.render(nil)
+		out.WriteString(text)
+	}
+
+	lines := strings.Split(out.String(), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, " ")
+	}
+	text := strings.Join(lines, "\n")
+	text = manyNewlines.ReplaceAllString(text, "\n\n")
+
+	return strings.TrimSpace(text), mentioned
+}
+
+type htmlAnchor struct {
+	href  string
+	class string
+	text  strings.Builder
+}
+
+// mentionPubkey is the pubkey of a mentioned pub actor, tests replace it so they
+// don't need a database.
+var mentionPubkey = func(actorUrl string) string {
+	_, pubkey := nostrKeysForPubActor(actorUrl)
+	return pubkey
+}
+
+// mentionedActor finds the Mention tag for this link. the link text is usually
+// just "@bob", which may be more than one bob, so the href is tried first and
+// then the full name, and the short name must point to the same server.
+func (a *htmlAnchor) mentionedActor(text string, tags []Tag) string {
+	mentions := make([]Tag, 0, len(tags))
+	for _, tag := range tags {
+		if tag.Type == "Mention" && tag.Href != "" {
+			mentions = append(mentions, tag)
+		}
+	}
+
+	for _, tag := range mentions {
+		if tag.Href == a.href {
+			return tag.Href
+		}
+	}
+	for _, tag := range mentions {
+		if strings.TrimPrefix(tag.Name, "@") == strings.TrimPrefix(text, "@") {
+			return tag.Href
+		}
+	}
+
+	var candidates []string
+	host := urlHost(a.href)
+	for _, tag := range mentions {
+		if !strings.HasPrefix(tag.Name, text+"@") {
+			continue
+		}
+		if host != "" && urlHost(tag.Href) == host {
+			return tag.Href
+		}
+		candidates = append(candidates, tag.Href)
+	}
+	if len(candidates) == 1 {
+		return candidates[0]
+	}
+	return ""
+}
+
+func urlHost(u string) string {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return ""
+	}
+	return parsed.Host
+}
+
+// render returns what should replace a link in the plain text and, if it is a
+// mention, the pubkey of who is being mentioned.
+func (a *htmlAnchor) render(tags []Tag) (string, string) {
+	text := strings.TrimSpace(htmlWhitespace.ReplaceAllString(a.text.String(), " "))
+	classes := strings.Fields(a.class)
+
+	switch {
+	case slices.Contains(classes, "hashtag") || strings.HasPrefix(text, "#"):
+		return text, ""
+	case slices.Contains(classes, "mention") || strings.HasPrefix(text, "@"):
+		if actorUrl := a.mentionedActor(text, tags); actorUrl != "" {
+			pubkey := mentionPubkey(actorUrl)
+			if npub, err := nip19.EncodePublicKey(pubkey); err == nil {
+				return "nostr:" + npub, pubkey
+			}
+		}
+		return text, ""
+	}
+
+	if !strings.HasPrefix(a.href, "http://") && !strings.HasPrefix(a.href, "https://") {
+		return text, ""
+	}
+
+	// links are usually displayed shortened, but sometimes they have a custom text
+	display := strings.TrimSuffix(strings.TrimSuffix(text, "…"), "...")
+	display = strings.TrimPrefix(strings.TrimPrefix(display, "https://"), "http://")
+	if display == "" || strings.Contains(a.href, display) {
+		return a.href, ""
+	}
+	return text + " (" + a.href + ")", ""
+}
+
+var (
+	nostrContentToken = regexp.MustCompile(`https?://[^\s<>"]+|nostr:(?:npub|nprofile|note|nevent)1[a-z0-9]+|#\[\d+\]|#[\p{L}\p{N}_]+`)
+	paragraphBreak    = regexp.MustCompile(`\n\s*\n`)
+)
+
+// htmlContentFromNostr renders the content of a nostr event as safe HTML for
+// pub, linkifying urls, hashtags and references to other nostr profiles and
+// notes. the Mention and Hashtag tags for what was found are returned.
+func htmlContentFromNostr(event nostr.Event) (string, []Tag) {
+	var (
+		out  strings.Builder
+		tags []Tag
+	)
+
+	mentions := make(map[string]Tag)
+	mention := func(pubkey string) string {
+		tag, ok := mentions[pubkey]
+		if !ok {
+			tag = pubMention(pubkey)
+			mentions[pubkey] = tag
+			tags = append(tags, tag)
+		}
+
+		// display just the username
+		name := strings.TrimPrefix(tag.Name, "@")
+		if at := strings.IndexByte(name, '@'); at != -1 {
+			name = name[:at]
+		}
+		return `<span class="h-card"><a href="` + html.EscapeString(tag.Href) +
+			`" class="u-url mention">@<span>` + html.EscapeString(name) + `</span></a></span>`
+	}
+	noteLink := func(id string) string {
+		noteUrl := html.EscapeString(pubNoteURL(id))
+		return `<a href="` + noteUrl + `">` + noteUrl + `</a>`
+	}
+
+	render := func(token string) string {
+		switch {
+		case strings.HasPrefix(token, "http"):
+			return `<a href="` + html.EscapeString(token) + `" rel="nofollow noopener noreferrer" target="_blank">` +
+				html.EscapeString(token) + `</a>`
+		case strings.HasPrefix(token, "nostr:"):
+			prefix, value, err := nip19.Decode(token[6:])
+			if err != nil {
+				break
+			}
+			switch v := value.(type) {
+			case string:
+				if prefix == "npub" {
+					return mention(v)
+				} else if prefix == "note" {
+					return noteLink(v)
+				}
+			case nip19.ProfilePointer:
+				return mention(v.PublicKey)
+			case nip19.EventPointer:
+				return noteLink(v.ID)
+			}
+		case strings.HasPrefix(token, "#["):
+			// NIP-08 mentions
+			idx, err := strconv.Atoi(token[2 : len(token)-1])
+			if err != nil || idx >= len(event.Tags) || len(event.Tags[idx]) < 2 {
+				break
+			}
+			switch tag := event.Tags[idx]; tag[0] {
+			case "p":
+				return mention(tag[1])
+			case "e":
+				return noteLink(tag[1])
+			}
+		default:
+			name := token[1:]
+			if strings.Trim(name, "0123456789") == "" {
+				// just a number
+				break
+			}
+			hashtag := pubHashtag(name)
+			if slices.IndexFunc(tags, func(t Tag) bool { return t.Href == hashtag.Href }) == -1 {
+				tags = append(tags, hashtag)
+			}
+			return `<a href="` + html.EscapeString(hashtag.Href) + `" class="mention hashtag" rel="tag">#<span>` +
+				html.EscapeString(name) + `</span></a>`
+		}
+		return html.EscapeString(token)
+	}
+
+	content := strings.TrimSpace(strings.ReplaceAll(event.Content, "\r\n", "\n"))
+	for _, paragraph := range paragraphBreak.Split(content, -1) {
+		out.WriteString("<p>")
+		for i, line := range strings.Split(paragraph, "\n") {
+			if i > 0 {
+				out.WriteString("<br>")
+			}
+
+			last := 0
+			for _, loc := range nostrContentToken.FindAllStringIndex(line, -1) {
+				start, end := loc[0], loc[1]
+				token := line[start:end]
+
+				// hashtags must not be glued to a word
+				if token[0] == '#' && token[1] != '[' && start > 0 && isWordByte(line[start-1]) {
+					continue
+				}
+
+				// urls don't end with punctuation
+				if token[0] == 'h' {
+					trimmed := strings.TrimRight(token, ".,;:!?)'")
+					end -= len(token) - len(trimmed)
+					token = trimmed
+				}
+
+				out.WriteString(html.EscapeString(line[last:start]))
+				out.WriteString(render(token))
+				last = end
+			}
+			out.WriteString(html.EscapeString(line[last:]))
+		}
+		out.WriteString("</p>")
+	}
+
+	return out.String(), tags
+}
+
+func pubHashtag(name string) Tag {
+	name = strings.ToLower(strings.TrimPrefix(name, "#"))
+	return Tag{
+		Type: "Hashtag",
+		Href: s.ServiceURL + "/pub/tag/" + url.PathEscape(name),
+		Name: "#" + name,
+	}
+}
+
+func isWordByte(b byte) bool {
+	return b == '_' || b == '&' || b >= 0x80 ||
+		(b >= '0' && b <= '9') || (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z')
+}
+
+var mediaExtensions = map[string]string{
+	"jpg":  "image/jpeg",
+	"jpeg": "image/jpeg",
+	"png":  "image/png",
+	"gif":  "image/gif",
+	"webp": "image/webp",
+	"avif": "image/avif",
+	"mp4":  "video/mp4",
+	"webm": "video/webm",
+	"mov":  "video/quicktime",
+	"mp3":  "audio/mpeg",
+	"ogg":  "audio/ogg",
+	"wav":  "audio/wav",
+}
+
+var mediaURL = regexp.MustCompile(`https?://[^\s<>"]+`)
+
+// nostrMediaFromPub returns the urls of the attachments of a pub note and the
+// imeta tags describing them.
+func nostrMediaFromPub(attachments []Attachment) ([]string, nostr.Tags) {
+	urls := make([]string, 0, len(attachments))
+	tags := make(nostr.Tags, 0, len(attachments))
+	for _, attachment := range attachments {
+		if attachment.URL == "" {
+			continue
+		}
+		urls = append(urls, attachment.URL)
+
+		imeta := nostr.Tag{"imeta", "url " + attachment.URL}
+		if attachment.MediaType != "" {
+			imeta = append(imeta, "m "+attachment.MediaType)
+		}
+		if attachment.Width > 0 && attachment.Height > 0 {
+			imeta = append(imeta, "dim "+strconv.Itoa(attachment.Width)+"x"+strconv.Itoa(attachment.Height))
+		}
+		if attachment.Blurhash != "" {
+			imeta = append(imeta, "blurhash "+attachment.Blurhash)
+		}
+		if attachment.Name != "" {
+			imeta = append(imeta, "alt "+attachment.Name)
+		}
+		tags = append(tags, imeta)
+	}
+	return urls, tags
+}
+
+// pubAttachmentsFromNostr turns the media urls in the content of a nostr event
+// into attachments, using what the imeta tags say about them when they exist.
+func pubAttachmentsFromNostr(event nostr.Event) []Attachment {
+	imetas := make(map[string]map[string]string)
+	for _, tag := range event.Tags.GetAll([]string{"imeta", ""}) {
+		fields := make(map[string]string, len(tag)-1)
+		for _, entry := range tag[1:] {
+			if space := strings.IndexByte(entry, ' '); space != -1 {
+				fields[entry[:space]] = entry[space+1:]
+			}
+		}
+		if fields["url"] != "" {
+			imetas[fields["url"]] = fields
+		}
+	}
+
+	var attachments []Attachment
+	for _, url := range mediaURL.FindAllString(event.Content, -1) {
+		url = strings.TrimRight(url, ".,;:!?)'")
+		if slices.IndexFunc(attachments, func(a Attachment) bool { return a.URL == url }) != -1 {
+			continue
+		}
+
+		imeta, described := imetas[url]
+		mediaType := imeta["m"]
+		if mediaType == "" {
+			path := url
+			if end := strings.IndexAny(path, "?#"); end != -1 {
+				path = path[:end]
+			}
+			if dot := strings.LastIndexByte(path, '.'); dot != -1 {
+				mediaType = mediaExtensions[strings.ToLower(path[dot+1:])]
+			}
+		}
+		if mediaType == "" && !described {
+			// not media
+			continue
+		}
+
+		attachment := Attachment{
+			Type:      "Document",
+			MediaType: mediaType,
+			URL:       url,
+			Name:      imeta["alt"],
+			Blurhash:  imeta["blurhash"],
+		}
+		if strings.HasPrefix(mediaType, "image/") {
+			attachment.Type = "Image"
+		}
+		if dim := strings.Split(imeta["dim"], "x"); len(dim) == 2 {
+			attachment.Width, _ = strconv.Atoi(dim[0])
+			attachment.Height, _ = strconv.Atoi(dim[1])
+		}
+		attachments = append(attachments, attachment)
+	}
+
+	return attachments
+}
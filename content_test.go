@@ -0,0 +1,159 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the expected files in testdata")
+
+// fakeMentionPubkeys makes up pubkeys for mentioned actors so no database is needed.
+func fakeMentionPubkeys(t *testing.T) {
+	previous := mentionPubkey
+	mentionPubkey = func(actorUrl string) string {
+		hash := sha256.Sum256([]byte(actorUrl))
+		return hex.EncodeToString(hash[:])
+	}
+	t.Cleanup(func() { mentionPubkey = previous })
+}
+
+// TestNostrContentFromHTMLGolden converts notes as they come from real servers,
+// the expected text is in a .txt file next to each of them.
+func TestNostrContentFromHTMLGolden(t *testing.T) {
+	fakeMentionPubkeys(t)
+
+	files, err := filepath.Glob("testdata/notes/*.json")
+	if err != nil || len(files) == 0 {
+		t.Fatalf("no notes in testdata: %v", err)
+	}
+
+	for _, file := range files {
+		t.Run(filepath.Base(file), func(t *testing.T) {
+			b, err := ioutil.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var note Note
+			if err := json.Unmarshal(b, &note); err != nil {
+				t.Fatal(err)
+			}
+
+			content, mentioned := nostrContentFromHTML(note.Content, note.Tag)
+			for _, pubkey := range mentioned {
+				content += "\n--- mentioned " + pubkey
+			}
+
+			golden := strings.TrimSuffix(file, ".json") + ".txt"
+			if *updateGolden {
+				if err := ioutil.WriteFile(golden, []byte(content+"\n"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			expected, err := ioutil.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if content+"\n" != string(expected) {
+				t.Fatalf("expected:\n%s\ngot:\n%s", expected, content)
+			}
+		})
+	}
+}
+
+func TestNostrContentFromHTML(t *testing.T) {
+	fakeMentionPubkeys(t)
+
+	tests := []struct {
+		name    string
+		content string
+		tags    []Tag
+		want    string
+	}{
+		{
+			name:    "paragraphs and line breaks",
+			content: "<p>one<br>two</p><p>three</p>",
+			want:    "one\ntwo\n\nthree",
+		},
+		{
+			name:    "entities",
+			content: "<p>a &amp; b &lt;c&gt; &quot;d&quot; &#x1F600;</p>",
+			want:    `a & b <c> "d" 😀`,
+		},
+		{
+			name:    "greater than inside an attribute",
+			content: `<a title="a>b" href="https://x.org">link</a>`,
+			want:    "link (https://x.org)",
+		},
+		{
+			name:    "shortened link",
+			content: `<a href="https://example.com/long/path"><span class="invisible">https://</span><span class="ellipsis">example.com/lo</span></a>`,
+			want:    "https://example.com/long/path",
+		},
+		{
+			name:    "scripts and comments are dropped",
+			content: "<p>before<script>alert('<p>')</script><!-- <b>x</b> --> after</p>",
+			want:    "before after",
+		},
+		{
+			name:    "mention of someone not tagged",
+			content: `<a href="https://a.social/@nobody" class="u-url mention">@<span>nobody</span></a>`,
+			tags:    []Tag{{Type: "Mention", Href: "https://a.social/users/bob", Name: "@bob@a.social"}},
+			want:    "@nobody",
+		},
+		{
+			name:    "ambiguous short name on another server",
+			content: `<a href="https://c.social/@bob" class="u-url mention">@<span>bob</span></a>`,
+			tags: []Tag{
+				{Type: "Mention", Href: "https://a.social/users/bob", Name: "@bob@a.social"},
+				{Type: "Mention", Href: "https://b.social/users/bob", Name: "@bob@b.social"},
+			},
+			want: "@bob",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, _ := nostrContentFromHTML(test.content, test.tags)
+			if got != test.want {
+				t.Fatalf("expected %q, got %q", test.want, got)
+			}
+		})
+	}
+}
+
+func TestMentionedActor(t *testing.T) {
+	tags := []Tag{
+		{Type: "Hashtag", Href: "https://a.social/tags/bob", Name: "#bob"},
+		{Type: "Mention", Href: "https://a.social/users/bob", Name: "@bob@a.social"},
+		{Type: "Mention", Href: "https://b.social/users/bob", Name: "@bob@b.social"},
+		{Type: "Mention", Href: "https://c.social/users/carol", Name: "@carol@c.social"},
+	}
+
+	tests := []struct {
+		href string
+		text string
+		want string
+	}{
+		{"https://b.social/users/bob", "@bob", "https://b.social/users/bob"},
+		{"https://b.social/@bob", "@bob", "https://b.social/users/bob"},
+		{"https://a.social/@bob", "@bob", "https://a.social/users/bob"},
+		{"https://elsewhere/@bob", "@bob@b.social", "https://b.social/users/bob"},
+		{"https://elsewhere/@carol", "@carol", "https://c.social/users/carol"},
+		{"https://elsewhere/@bob", "@bob", ""},
+		{"https://a.social/@dave", "@dave", ""},
+	}
+
+	for _, test := range tests {
+		a := &htmlAnchor{href: test.href}
+		if got := a.mentionedActor(test.text, tags); got != test.want {
+			t.Errorf("%s %s: expected %q, got %q", test.href, test.text, test.want, got)
+		}
+	}
+}
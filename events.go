@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+type eventRow struct {
+	ID        string     `db:"id"`
+	PubKey    string     `db:"pubkey"`
+	CreatedAt int64      `db:"created_at"`
+	Kind      int        `db:"kind"`
+	Tags      nostr.Tags `db:"tags"`
+	Content   string     `db:"content"`
+	Sig       string     `db:"sig"`
+}
+
+func (row eventRow) event() nostr.Event {
+	return nostr.Event{
+		ID:        row.ID,
+		PubKey:    row.PubKey,
+		CreatedAt: time.Unix(row.CreatedAt, 0),
+		Kind:      row.Kind,
+		Tags:      row.Tags,
+		Content:   row.Content,
+		Sig:       row.Sig,
+	}
+}
+
+func isReplaceable(kind int) bool {
+	return kind == 0 || kind == 3 || (kind >= 10000 && kind < 20000)
+}
+
+// saveEvent stores an event permanently, returns false if we already had it
+// (or a newer version of it, in the case of replaceable events).
+func saveEvent(evt nostr.Event) (bool, error) {
+	if isReplaceable(evt.Kind) {
+		var newer bool
+		if err := pg.Get(&newer, `
+            SELECT EXISTS (
+              SELECT 1 FROM events
+              WHERE pubkey = $1 AND kind = $2 AND created_at >= $3
+            )
+        `, evt.PubKey, evt.Kind, evt.CreatedAt.Unix()); err != nil {
+			return false, err
+		}
+		if newer {
+			return false, nil
+		}
+
+		if _, err := pg.Exec(
+			"DELETE FROM events WHERE pubkey = $1 AND kind = $2",
+			evt.PubKey, evt.Kind,
+		); err != nil {
+			return false, err
+		}
+	}
+
+	if evt.Tags == nil {
+		evt.Tags = make(nostr.Tags, 0)
+	}
+	jtags, _ := json.Marshal(evt.Tags)
+
+	res, err := pg.Exec(`
+        INSERT INTO events (id, pubkey, created_at, kind, tags, content, sig)
+        VALUES ($1, $2, $3, $4, $5, $6, $7)
+        ON CONFLICT (id) DO NOTHING
+    `, evt.ID, evt.PubKey, evt.CreatedAt.Unix(), evt.Kind, string(jtags), evt.Content, evt.Sig)
+	if err != nil {
+		return false, err
+	}
+
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+func deleteEvent(id string, pubkey string) error {
+	_, err := pg.Exec("DELETE FROM events WHERE id = $1 AND pubkey = $2", id, pubkey)
+	return err
+}
+
+// queryEvents returns the stored events matching a NIP-01 filter, newest first.
+func queryEvents(filter nostr.Filter) ([]nostr.Event, error) {
+	return queryEventsOrdered(filter, false)
+}
+
+// queryEventsOrdered is like queryEvents, but with ascending the limit takes the
+// oldest events instead and they come oldest first.
+func queryEventsOrdered(filter nostr.Filter, ascending bool) ([]nostr.Event, error) {
+	conditions := make([]string, 0, 7)
+	params := make([]any, 0, 20)
+	param := func(v any) string {
+		params = append(params, v)
+		return fmt.Sprintf("$%d", len(params))
+	}
+
+	// ids and authors can be prefixes
+	prefixes := func(column string, values []string) string {
+		ors := make([]string, 0, len(values))
+		for _, v := range values {
+			if len(v) > 64 || !isHex(v) {
+				continue
+			}
+			ors = append(ors, column+" LIKE "+param(strings.ToLower(v)+"%"))
+		}
+		if len(ors) == 0 {
+			return "false"
+		}
+		return "(" + strings.Join(ors, " OR ") + ")"
+	}
+
+	if filter.IDs != nil {
+		conditions = append(conditions, prefixes("id", filter.IDs))
+	}
+	if filter.Authors != nil {
+		conditions = append(conditions, prefixes("pubkey", filter.Authors))
+	}
+	if filter.Kinds != nil {
+		kinds := make(pq.Int64Array, len(filter.Kinds))
+		for i, k := range filter.Kinds {
+			kinds[i] = int64(k)
+		}
+		conditions = append(conditions, "kind = ANY("+param(kinds)+")")
+	}
+	for name, values := range filter.Tags {
+		if values == nil {
+			continue
+		}
+		// @> narrows it down with the index, but it would also match the value
+		// anywhere in a tag, so the name and the value are checked after
+		ors := make([]string, len(values))
+		for i, v := range values {
+			jtag, _ := json.Marshal([]nostr.Tag{{name, v}})
+			ors[i] = "(tags @> " + param(string(jtag)) + "::jsonb AND EXISTS (" +
+				"SELECT 1 FROM jsonb_array_elements(tags) tag " +
+				"WHERE tag->>0 = " + param(name) + " AND tag->>1 = " + param(v) + "))"
+		}
+		if len(ors) == 0 {
+			ors = append(ors, "false")
+		}
+		conditions = append(conditions, "("+strings.Join(ors, " OR ")+")")
+	}
+	if filter.Since != nil {
+		conditions = append(conditions, "created_at >= "+param(filter.Since.Unix()))
+	}
+	if filter.Until != nil {
+		conditions = append(conditions, "created_at <= "+param(filter.Until.Unix()))
+	}
+	if len(conditions) == 0 {
+		conditions = append(conditions, "true")
+	}
+
+	limit := 500
+	if filter.Limit > 0 && filter.Limit < limit {
+		limit = filter.Limit
+	}
+
+	order := "DESC"
+	if ascending {
+		order = "ASC"
+	}
+
+	var rows []eventRow
+	err := pg.Select(&rows, `
+        SELECT id, pubkey, created_at, kind, tags, content, sig FROM events
+        WHERE `+strings.Join(conditions, " AND ")+`
+        ORDER BY created_at `+order+`, id `+order+`
+        LIMIT `+param(limit),
+		params...)
+	if err != nil {
+		return nil, err
+	}
+
+	events := make([]nostr.Event, len(rows))
+	for i, row := range rows {
+		events[i] = row.event()
+	}
+	return events, nil
+}
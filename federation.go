@@ -0,0 +1,426 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/fiatjaf/litepub"
+	"github.com/lib/pq"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+const watchInterval = 10 * time.Minute
+
+// watchFollowedPubkeys keeps subscriptions open on some upstream relays for
+// events from all the nostr pubkeys that have pub followers. the list of
+// pubkeys is refreshed every watchInterval.
+func watchFollowedPubkeys() {
+	since := time.Now()
+
+	for {
+		var pubkeys []string
+		if err := pg.Select(&pubkeys, "SELECT DISTINCT nostr_pubkey FROM followers"); err != nil {
+			log.Warn().Err(err).Msg("failed to load followed pubkeys")
+		}
+		if len(pubkeys) == 0 {
+			time.Sleep(watchInterval)
+			since = time.Now()
+			continue
+		}
+
+		roundSince := since
+		filters := nostr.Filters{{
+			Kinds:   []int{0, 1, 5, 6, 7, 1018},
+			Authors: pubkeys,
+			Since:   &roundSince,
+		}}
+
+		ctx, cancel := context.WithTimeout(context.Background(), watchInterval)
+		events := make(chan nostr.Event)
+		for i := 0; i < 4; i++ {
+			go watchRelay(ctx, nextRelay(), filters, events)
+		}
+
+	round:
+		for {
+			select {
+			case evt := <-events:
+				isNew, err := saveEvent(evt)
+				if err != nil {
+					log.Warn().Err(err).Interface("evt", evt).Msg("failed to save watched event")
+				}
+				if isNew {
+					go federateEvent(evt)
+				}
+			case <-ctx.Done():
+				break round
+			}
+		}
+		cancel()
+
+		// the next round starts where this one ended, overlapping by a minute so we
+		// don't miss what arrives while it connects, duplicates are caught when saving
+		since = time.Now().Add(-1 * time.Minute)
+	}
+}
+
+func watchRelay(ctx context.Context, url string, filters nostr.Filters, events chan<- nostr.Event) {
+	r, err := nostr.RelayConnect(ctx, url)
+	if err != nil {
+		log.Debug().Err(err).Str("relay", url).Msg("failed to connect to watch relay")
+		return
+	}
+	defer r.Close()
+
+	sub := r.Subscribe(ctx, filters)
+	for {
+		select {
+		case evt, ok := <-sub.Events:
+			if !ok {
+				return
+			}
+			select {
+			case events <- evt:
+			case <-ctx.Done():
+				return
+			}
+		case <-r.Notices:
+		case err := <-r.ConnectionError:
+			log.Debug().Err(err).Str("relay", url).Msg("watch relay connection closed")
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// federateEvent sends a nostr event we haven't seen before to the pub
+// followers of its author.
+func federateEvent(evt nostr.Event) {
+	switch evt.Kind {
+	case 0:
+		// so our actor is also up-to-date
+		cacheEvent(evt)
+
+		actor := pubActorFromNostrEvent(evt)
+		deliverToFollowers(evt.PubKey, Activity{
+			Base: litepub.Base{
+				Type: "Update",
+				Id:   s.ServiceURL + "/pub/update/" + evt.ID,
+			},
+			Actor:  actor.Id,
+			Object: actor,
+			To:     []string{"https://www.w3.org/ns/activitystreams#Public"},
+		})
+	case 1:
+		note := pubNoteFromNostrEvent(evt)
+		create := wrapCreate(note, s.ServiceURL+"/pub/create/"+evt.ID)
+
+		// also send to whoever is mentioned or being replied to
+		deliverToFollowers(evt.PubKey, create, mentionedPubActors(note)...)
+	case 3:
+		syncPubFollows(evt)
+	case 5:
+		for _, tag := range evt.Tags.GetAll([]string{"e", ""}) {
+			if err := deleteAndFederate(tag.Value(), evt.PubKey); err != nil {
+				log.Warn().Err(err).Str("id", tag.Value()).Msg("failed to delete event")
+			}
+		}
+	case 6:
+		if announce, ok := pubAnnounceFromNostrEvent(evt); ok {
+			// the author of the reposted note must know about it too
+			others := make([]string, 0, 1)
+			for _, actor := range announce.CC {
+				if !strings.HasPrefix(actor, s.ServiceURL) {
+					others = append(others, actor)
+				}
+			}
+			deliverToFollowers(evt.PubKey, announce, others...)
+		}
+	case 7:
+		// only reactions to notes that came from pub matter
+		if like, author, ok := pubLikeFromNostrEvent(evt); ok {
+			deliverToActors(evt.PubKey, like, author)
+		}
+	case 1018:
+		// votes on polls that came from pub
+		if votes, author, ok := pubVotesFromNostrEvent(evt); ok {
+			for _, vote := range votes {
+				deliverToActors(evt.PubKey, vote, author)
+			}
+		}
+	}
+}
+
+// syncPubFollows sends Follow and Undo{Follow} activities so the pub actors a nostr
+// pubkey follows match the bridged pubkeys in their contact list.
+func syncPubFollows(evt nostr.Event) {
+	ptags := evt.Tags.GetAll([]string{"p", ""})
+	contacts := make(pq.StringArray, len(ptags))
+	for i, tag := range ptags {
+		contacts[i] = tag.Value()
+	}
+
+	var keys []struct {
+		Pubkey   string `db:"nostr_pubkey"`
+		ActorUrl string `db:"pub_actor_url"`
+	}
+	if err := pg.Select(&keys, `
+        SELECT nostr_pubkey, pub_actor_url FROM keys WHERE nostr_pubkey = ANY($1)
+    `, contacts); err != nil {
+		log.Warn().Err(err).Str("pubkey", evt.PubKey).Msg("failed to load bridged contacts")
+		return
+	}
+	wanted := make(map[string]string, len(keys)) // map[actor url]bridged pubkey
+	for _, k := range keys {
+		wanted[k.ActorUrl] = k.Pubkey
+	}
+
+	// follows that were never answered are sent again after a while
+	var follows []struct {
+		ActorUrl string `db:"pub_actor_url"`
+		FollowId string `db:"follow_id"`
+		Stale    bool   `db:"stale"`
+	}
+	if err := pg.Select(&follows, `
+        SELECT pub_actor_url, follow_id,
+          status = 'pending' AND followed_at < now() - interval '1 day' AS stale
+        FROM following WHERE nostr_pubkey = $1
+    `, evt.PubKey); err != nil {
+		log.Warn().Err(err).Str("pubkey", evt.PubKey).Msg("failed to load followed pub actors")
+		return
+	}
+	current := make(map[string]string, len(follows)) // map[actor url]follow id
+	stale := make(map[string]bool)
+	for _, f := range follows {
+		current[f.ActorUrl] = f.FollowId
+		stale[f.ActorUrl] = f.Stale
+	}
+
+	actor := s.ServiceURL + "/pub/user/" + evt.PubKey
+
+	for actorUrl, bridgedPubkey := range wanted {
+		if _, ok := current[actorUrl]; ok && !stale[actorUrl] {
+			continue
+		}
+
+		follow := litepub.Follow{
+			Base: litepub.Base{
+				Type: "Follow",
+				Id:   s.ServiceURL + "/pub/follow/" + evt.ID + "/" + bridgedPubkey,
+			},
+			Actor:  actor,
+			Object: actorUrl,
+		}
+
+		// only remember the follow if we can send it, so it's tried again next time
+		inbox, err := actorInbox(actorUrl)
+		if err != nil {
+			log.Debug().Err(err).Str("actor", actorUrl).Msg("didn't find an inbox to follow")
+			continue
+		}
+		if _, err := pg.Exec(`
+            INSERT INTO following (nostr_pubkey, pub_actor_url, follow_id)
+            VALUES ($1, $2, $3)
+            ON CONFLICT (nostr_pubkey, pub_actor_url)
+              DO UPDATE SET follow_id = EXCLUDED.follow_id, followed_at = now()
+        `, evt.PubKey, actorUrl, follow.Id); err != nil {
+			log.Warn().Err(err).Str("actor", actorUrl).Msg("failed to save following")
+			continue
+		}
+		enqueueDelivery(evt.PubKey, inbox, follow)
+	}
+
+	for actorUrl, followId := range current {
+		if _, ok := wanted[actorUrl]; ok {
+			continue
+		}
+
+		if _, err := pg.Exec(`
+            DELETE FROM following WHERE nostr_pubkey = $1 AND pub_actor_url = $2
+        `, evt.PubKey, actorUrl); err != nil {
+			log.Warn().Err(err).Str("actor", actorUrl).Msg("failed to delete following")
+			continue
+		}
+		deliverToActors(evt.PubKey, Activity{
+			Base: litepub.Base{
+				Type: "Undo",
+				Id:   followId + "/undo",
+			},
+			Actor: actor,
+			Object: litepub.Follow{
+				Base: litepub.Base{
+					Type: "Follow",
+					Id:   followId,
+				},
+				Actor:  actor,
+				Object: actorUrl,
+			},
+		}, actorUrl)
+	}
+}
+
+// deleteAndFederate handles a nostr pubkey asking for one of its events to be
+// deleted. events from someone else are left alone.
+func deleteAndFederate(id string, pubkey string) error {
+	// find it before it's gone, we need to know what it was to tell pub about it
+	evt := findEvent(id)
+	if evt == nil || evt.PubKey != pubkey {
+		log.Debug().Str("id", id).Str("pubkey", pubkey).Msg("ignoring deletion of an event that isn't theirs")
+		return nil
+	}
+
+	if err := deleteEvent(id, pubkey); err != nil {
+		return err
+	}
+	go federateDeletion(*evt)
+	return nil
+}
+
+// federateDeletion tells the pub followers of a nostr pubkey that one of their
+// events is gone, it only happens once for each event.
+func federateDeletion(evt nostr.Event) {
+	uncacheEvent(evt.ID, evt.PubKey)
+
+	res, err := pg.Exec(`
+        INSERT INTO tombstones (nostr_event_id, nostr_pubkey)
+        VALUES ($1, $2)
+        ON CONFLICT (nostr_event_id) DO NOTHING
+    `, evt.ID, evt.PubKey)
+	if err != nil {
+		log.Warn().Err(err).Str("id", evt.ID).Msg("failed to save tombstone")
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return
+	}
+
+	actor := s.ServiceURL + "/pub/user/" + evt.PubKey
+	switch evt.Kind {
+	case 6:
+		// reposts and reactions are undone instead
+		if announce, ok := pubAnnounceFromNostrEvent(evt); ok {
+			others := make([]string, 0, 1)
+			for _, cc := range announce.CC {
+				if !strings.HasPrefix(cc, s.ServiceURL) {
+					others = append(others, cc)
+				}
+			}
+			deliverToFollowers(evt.PubKey, Activity{
+				Base:   litepub.Base{Type: "Undo", Id: announce.Id + "/undo"},
+				Actor:  actor,
+				Object: announce,
+				To:     announce.To,
+				CC:     announce.CC,
+			}, others...)
+		}
+	case 7:
+		if like, author, ok := pubLikeFromNostrEvent(evt); ok {
+			deliverToActors(evt.PubKey, Activity{
+				Base:   litepub.Base{Type: "Undo", Id: like.Id + "/undo"},
+				Actor:  actor,
+				Object: like,
+			}, author)
+		}
+	default:
+		deleted := time.Now()
+		deliverToFollowers(evt.PubKey, Activity{
+			Base: litepub.Base{
+				Type: "Delete",
+				Id:   s.ServiceURL + "/pub/delete/" + evt.ID,
+			},
+			Actor: actor,
+			Object: Tombstone{
+				Base: litepub.Base{
+					Type: "Tombstone",
+					Id:   s.ServiceURL + "/pub/note/" + evt.ID,
+				},
+				FormerType: "Note",
+				Deleted:    &deleted,
+			},
+			To: []string{"https://www.w3.org/ns/activitystreams#Public"},
+		})
+	}
+}
+
+// mentionedPubActors returns the actors from other servers mentioned in a note.
+func mentionedPubActors(note Note) []string {
+	actors := make([]string, 0, len(note.Tag))
+	for _, tag := range note.Tag {
+		if tag.Type == "Mention" && !strings.HasPrefix(tag.Href, s.ServiceURL) {
+			actors = append(actors, tag.Href)
+		}
+	}
+	return actors
+}
+
+// deliverToFollowers sends an activity to the inboxes of the pub followers of a
+// nostr pubkey and also to the inboxes of any other actors given.
+func deliverToFollowers(pubkey string, activity any, others ...string) {
+	var followers []struct {
+		ActorUrl string `db:"pub_actor_url"`
+		Inbox    string `db:"inbox"`
+	}
+	if err := pg.Select(&followers, `
+        SELECT pub_actor_url, coalesce(nullif(shared_inbox, ''), inbox) AS inbox
+        FROM followers WHERE nostr_pubkey = $1
+    `, pubkey); err != nil {
+		log.Warn().Err(err).Str("pubkey", pubkey).Msg("failed to load followers")
+		return
+	}
+
+	// many followers may share the same inbox
+	inboxes := make(map[string]bool, len(followers))
+	for _, follower := range followers {
+		if follower.Inbox == "" {
+			// followed us before we stored inboxes
+			inbox, sharedInbox, err := actorInboxes(follower.ActorUrl)
+			if err != nil {
+				log.Debug().Err(err).Str("actor", follower.ActorUrl).Msg("didn't find an inbox")
+				continue
+			}
+			pg.Exec(`
+                UPDATE followers SET inbox = $1, shared_inbox = $2 WHERE pub_actor_url = $3
+            `, inbox, sharedInbox, follower.ActorUrl)
+
+			follower.Inbox = inbox
+			if sharedInbox != "" {
+				follower.Inbox = sharedInbox
+			}
+		}
+		inboxes[follower.Inbox] = true
+	}
+
+	for _, actor := range others {
+		inbox, err := actorInbox(actor)
+		if err != nil {
+			log.Debug().Err(err).Str("actor", actor).Msg("didn't find an inbox")
+			continue
+		}
+		inboxes[inbox] = true
+	}
+
+	for inbox := range inboxes {
+		enqueueDelivery(pubkey, inbox, activity)
+	}
+}
+
+// deliverToActors sends an activity signed by the actor of the given nostr pubkey
+// to the inboxes of the given pub actors.
+func deliverToActors(pubkey string, activity any, actors ...string) {
+	// many actors may share the same inbox
+	inboxes := make(map[string]bool, len(actors))
+	for _, actor := range actors {
+		inbox, err := actorInbox(actor)
+		if err != nil {
+			log.Debug().Err(err).Str("actor", actor).Msg("didn't find an inbox")
+			continue
+		}
+		inboxes[inbox] = true
+	}
+
+	for inbox := range inboxes {
+		enqueueDelivery(pubkey, inbox, activity)
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/tidwall/gjson"
+)
+
+// fetchPubObject gets any activitypub object, for when we need the fields
+// litepub doesn't know about.
+func fetchPubObject(url string) (gjson.Result, error) {
+	r, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return gjson.Result{}, err
+	}
+
+	r.Header.Set("Accept", "application/activity+json")
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		return gjson.Result{}, err
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return gjson.Result{}, err
+	}
+	if resp.StatusCode >= 300 {
+		return gjson.Result{}, fmt.Errorf("got status %d from %s", resp.StatusCode, url)
+	}
+	if !gjson.ValidBytes(b) {
+		return gjson.Result{}, fmt.Errorf("got invalid json from %s", url)
+	}
+
+	return gjson.ParseBytes(b), nil
+}
+
+func fetchNote(url string) (*Note, error) {
+	object, err := fetchPubObject(url)
+	if err != nil {
+		return nil, err
+	}
+
+	var note Note
+	if err := json.Unmarshal([]byte(object.Raw), &note); err != nil {
+		return nil, fmt.Errorf("error unmarshaling note from %s: %w", url, err)
+	}
+	return &note, nil
+}
+
+// noteFromObject handles the "object" of activities, which can be embedded or
+// just be an url.
+func noteFromObject(object gjson.Result) (*Note, error) {
+	if object.Type == gjson.String {
+		return fetchNote(object.String())
+	}
+
+	var note Note
+	if err := json.Unmarshal([]byte(object.Raw), &note); err != nil {
+		return nil, err
+	}
+	return &note, nil
+}
+
+// fetchNotes gets the notes from the first pages of an actor's outbox.
+func fetchNotes(outboxUrl string) ([]Note, error) {
+	outbox, err := fetchPubObject(outboxUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	page := outbox.Get("first")
+	var notes []Note
+	for i := 0; i < 5 /* hard limit at 5 pages */ && len(notes) < 100 && page.Exists(); i++ {
+		if page.Type == gjson.String {
+			if page, err = fetchPubObject(page.String()); err != nil {
+				break
+			}
+		}
+
+		for _, item := range page.Get("orderedItems").Array() {
+			if item.Get("type").String() != "Create" {
+				continue
+			}
+
+			note, err := noteFromObject(item.Get("object"))
+			if err != nil || !note.isNote() {
+				continue
+			}
+			notes = append(notes, *note)
+		}
+
+		page = page.Get("next")
+	}
+
+	return notes, nil
+}
+
+// fetchReplies goes through the first pages of the replies collection of a note.
+func fetchReplies(noteUrl string) []Note {
+	note, err := fetchPubObject(noteUrl)
+	if err != nil {
+		log.Debug().Err(err).Str("note", noteUrl).Msg("failed to fetch note for replies")
+		return nil
+	}
+
+	replies := note.Get("replies")
+	if replies.Type == gjson.String {
+		if replies, err = fetchPubObject(replies.String()); err != nil {
+			return nil
+		}
+	}
+
+	page := replies.Get("first")
+	if replies.Get("items").Exists() || replies.Get("orderedItems").Exists() {
+		page = replies
+	}
+
+	var notes []Note
+	for i := 0; i < 3 /* hard limit at 3 pages */ && page.Exists(); i++ {
+		if page.Type == gjson.String {
+			if page, err = fetchPubObject(page.String()); err != nil {
+				break
+			}
+		}
+
+		items := page.Get("items")
+		if !items.Exists() {
+			items = page.Get("orderedItems")
+		}
+
+		for _, item := range items.Array() {
+			reply, err := noteFromObject(item)
+			if err != nil {
+				continue
+			}
+
+			if reply.isNote() {
+				notes = append(notes, *reply)
+			}
+		}
+
+		page = page.Get("next")
+	}
+
+	return notes
+}
+
+// actorInbox returns the shared inbox of an actor or, if it doesn't have
+// one, its personal inbox.
+func actorInbox(actorUrl string) (string, error) {
+	inbox, sharedInbox, err := actorInboxes(actorUrl)
+	if sharedInbox != "" {
+		return sharedInbox, nil
+	}
+	return inbox, err
+}
+
+// actorInboxes returns the personal inbox of an actor and its shared inbox,
+// which may be empty.
+func actorInboxes(actorUrl string) (string, string, error) {
+	actor, err := fetchPubObject(actorUrl)
+	if err != nil {
+		return "", "", err
+	}
+
+	inbox := actor.Get("inbox").String()
+	if inbox == "" {
+		return "", "", fmt.Errorf("actor %s has no inbox", actorUrl)
+	}
+	return inbox, actor.Get("endpoints.sharedInbox").String(), nil
+}
+
+// actorIsGone checks if an actor was deleted from their server.
+func actorIsGone(actorUrl string) bool {
+	r, err := http.NewRequest("GET", actorUrl, nil)
+	if err != nil {
+		return false
+	}
+
+	r.Header.Set("Accept", "application/activity+json")
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+
+	return resp.StatusCode == 410 || resp.StatusCode == 404
+}
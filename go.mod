@@ -6,7 +6,6 @@ require (
 	github.com/fiatjaf/litepub v1.2.0
 	github.com/fiatjaf/relayer v1.5.2
 	github.com/gorilla/mux v1.8.0
-	github.com/grokify/html-strip-tags-go v0.0.1
 	github.com/jmoiron/sqlx v1.3.4
 	github.com/kelseyhightower/envconfig v1.4.0
 	github.com/lib/pq v1.10.4
@@ -14,6 +13,7 @@ require (
 	github.com/rs/zerolog v1.26.1
 	github.com/tidwall/gjson v1.14.3
 	golang.org/x/exp v0.0.0-20221106115401-f9659909a136
+	golang.org/x/net v0.11.0
 )
 
 require (
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip10"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+var pageTemplate = template.Must(template.New("page").Parse(`<!DOCTYPE html>
+<html>
+<head>
+  <meta charset="utf-8">
+  <meta name="viewport" content="width=device-width, initial-scale=1">
+  <title>{{.Title}}</title>
+  <link rel="alternate" type="application/activity+json" href="{{.ActivityURL}}">
+  <style>
+    body { max-width: 640px; margin: 0 auto; padding: 1em; font-family: sans-serif; line-height: 1.4; }
+    header img { width: 96px; height: 96px; border-radius: 50%; object-fit: cover; }
+    header .about { white-space: pre-wrap; }
+    article { border-bottom: 1px solid #ddd; padding: 1em 0; }
+    article.highlight { font-size: 1.15em; }
+    article .author { font-weight: bold; }
+    article footer, .nip05, code { color: #777; font-size: 0.85em; }
+    article img { max-width: 100%; }
+    a { color: #6441a5; word-break: break-word; }
+  </style>
+</head>
+<body>
+  {{with .Profile}}
+  <header>
+    {{if .Picture}}<img src="{{.Picture}}" alt="">{{end}}
+    <h1>{{.Name}}</h1>
+    {{if .NIP05}}<p class="nip05">{{.NIP05}}</p>{{end}}
+    <p class="about">{{.About}}</p>
+    <p><a href="{{.URI}}">open in a nostr client</a> <code>{{.Npub}}</code></p>
+  </header>
+  {{end}}
+  <main>
+    {{range .Notes}}
+    <article{{if .Highlight}} class="highlight"{{end}}>
+      <div class="author"><a href="{{.AuthorURL}}">{{.AuthorName}}</a></div>
+      <div class="content">{{.Content}}</div>
+      <footer>
+        <a href="{{.URL}}">{{.CreatedAt.UTC.Format "2006-01-02 15:04"}}</a>
+        · <a href="{{.URI}}">open in a nostr client</a>
+      </footer>
+    </article>
+    {{else}}
+    <p>nothing here yet.</p>
+    {{end}}
+  </main>
+</body>
+</html>`))
+
+type htmlPage struct {
+	Title       string
+	ActivityURL string
+	Profile     *htmlProfile
+	Notes       []htmlNote
+}
+
+type htmlProfile struct {
+	Name    string
+	About   string
+	Picture string
+	NIP05   string
+	Npub    string
+	URI     template.URL
+}
+
+type htmlNote struct {
+	AuthorName string
+	AuthorURL  string
+	Content    template.HTML
+	CreatedAt  time.Time
+	URL        string
+	URI        template.URL
+	Highlight  bool
+}
+
+// wantsHTML tells if a request comes from a browser instead of from a pub server.
+func wantsHTML(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, "text/html") &&
+		!strings.Contains(accept, "application/activity+json") &&
+		!strings.Contains(accept, "application/ld+json")
+}
+
+func renderProfilePage(w http.ResponseWriter, metadataEvent nostr.Event) {
+	pubkey := metadataEvent.PubKey
+	npub, _ := nip19.EncodePublicKey(pubkey)
+
+	profile := &htmlProfile{Npub: npub, URI: template.URL("nostr:" + npub)}
+	if metadata, err := nostr.ParseMetadata(metadataEvent); err == nil {
+		profile.Name = metadata.Name
+		profile.About = metadata.About
+		profile.Picture = metadata.Picture
+		profile.NIP05 = metadata.NIP05
+	}
+	if profile.Name == "" {
+		profile.Name = shortNpub(npub)
+	}
+
+	page := htmlPage{
+		Title:       profile.Name,
+		ActivityURL: s.ServiceURL + "/pub/user/" + pubkey,
+		Profile:     profile,
+	}
+	for _, evt := range outboxEvents(pubkey, nil, nil, nil) {
+		if evt.Kind == 1 {
+			page.Notes = append(page.Notes, htmlNoteFromNostrEvent(evt))
+		}
+	}
+
+	renderPage(w, page)
+}
+
+// renderNotePage shows a note along with what it is replying to and its replies.
+func renderNotePage(w http.ResponseWriter, evt nostr.Event) {
+	thread := []nostr.Event{evt}
+	for i := 0; i < 5; /* don't go too far up */ i++ {
+		reply := nip10.GetImmediateReply(thread[0].Tags)
+		if reply == nil {
+			break
+		}
+		parent := findEvent(reply.Value())
+		if parent == nil {
+			break
+		}
+		thread = append([]nostr.Event{*parent}, thread...)
+	}
+
+	filter := nostr.Filter{Kinds: []int{1}, Tags: nostr.TagMap{"e": {evt.ID}}, Limit: 50}
+	replies, err := queryEvents(filter)
+	if err != nil {
+		log.Warn().Err(err).Str("id", evt.ID).Msg("failed to query stored replies")
+	}
+	if len(replies) == 0 {
+		replies = querySync(filter, 20)
+	}
+	sort.Slice(replies, func(i, j int) bool {
+		return replies[i].CreatedAt.Before(replies[j].CreatedAt)
+	})
+
+	page := htmlPage{ActivityURL: s.ServiceURL + "/pub/note/" + evt.ID}
+	for _, e := range append(thread, replies...) {
+		note := htmlNoteFromNostrEvent(e)
+		if e.ID == evt.ID {
+			note.Highlight = true
+			page.Title = note.AuthorName
+		}
+		page.Notes = append(page.Notes, note)
+	}
+
+	renderPage(w, page)
+}
+
+func renderPage(w http.ResponseWriter, page htmlPage) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := pageTemplate.Execute(w, page); err != nil {
+		log.Warn().Err(err).Str("page", page.ActivityURL).Msg("failed to render page")
+	}
+}
+
+func htmlNoteFromNostrEvent(evt nostr.Event) htmlNote {
+	npub, _ := nip19.EncodePublicKey(evt.PubKey)
+	nevent, _ := nip19.EncodeEvent(evt.ID, []string{s.RelayURL})
+
+	authorName := shortNpub(npub)
+	if metadata := storedMetadata(evt.PubKey); metadata != nil && metadata.Name != "" {
+		authorName = metadata.Name
+	}
+	authorUrl, _ := pubActorURL(evt.PubKey)
+
+	// this is already safe, see htmlContentFromNostr
+	content, _ := htmlContentFromNostr(evt)
+
+	return htmlNote{
+		AuthorName: authorName,
+		AuthorURL:  authorUrl,
+		Content:    template.HTML(content),
+		CreatedAt:  evt.CreatedAt,
+		URL:        pubNoteURL(evt.ID),
+		URI:        template.URL("nostr:" + nevent),
+	}
+}
+
+// storedMetadata gets the metadata of a pubkey only if we have it already,
+// pages would take too long to load if we asked relays for everybody.
+func storedMetadata(pubkey string) *nostr.ProfileMetadata {
+	var evt *nostr.Event
+	stored, err := queryEvents(nostr.Filter{Kinds: []int{0}, Authors: []string{pubkey}, Limit: 1})
+	if err == nil && len(stored) > 0 {
+		evt = &stored[0]
+	} else if evt = getCachedMetadata(pubkey); evt == nil {
+		return nil
+	}
+
+	metadata, err := nostr.ParseMetadata(*evt)
+	if err != nil {
+		return nil
+	}
+	return metadata
+}
+
+func shortNpub(npub string) string {
+	if len(npub) < 20 {
+		return npub
+	}
+	return npub[0:12] + "…" + npub[len(npub)-6:]
+}
+
+// redirectToProfile handles the vanity /{pubkey}, /{npub} and /{nprofile} urls.
+func redirectToProfile(w http.ResponseWriter, r *http.Request) {
+	pubkey, _, ok := decodePubkey(mux.Vars(r)["pubkey"])
+	if !ok {
+		http.Error(w, "invalid pubkey", 404)
+		return
+	}
+
+	http.Redirect(w, r, "/pub/user/"+pubkey, 302)
+}
@@ -1,14 +1,12 @@
 package main
 
 import (
-	"crypto/rsa"
 	"fmt"
 	"net/http"
 	"os"
 	"strings"
 	"time"
 
-	"github.com/fiatjaf/litepub"
 	"github.com/fiatjaf/relayer"
 	"github.com/jmoiron/sqlx"
 	"github.com/kelseyhightower/envconfig"
@@ -23,10 +21,18 @@ type Settings struct {
 	Port        string `envconfig:"PORT" required:"true"`
 	PostgresURL string `envconfig:"DATABASE_URL" required:"true"`
 	IconSVG     string `envconfig:"ICON"`
-	Secret      string `envconfig:"SECRET"`
 
-	PrivateKey   *rsa.PrivateKey
-	PublicKeyPEM string
+	// the nostr keys of pub actors are derived from this, so changing it changes
+	// the nostr identity of every pub actor we haven't seen yet. it should be long
+	// (32+ characters) but short ones still work, so old deployments keep their keys.
+	Secret string `envconfig:"SECRET" required:"true"`
+
+	DeliveryMaxAttempts int `envconfig:"DELIVERY_MAX_ATTEMPTS" default:"10"`
+	DeadInboxFailures   int `envconfig:"DEAD_INBOX_FAILURES" default:"3"`
+
+	// nostr users can claim name@our-domain if this is enabled
+	Registrations bool     `envconfig:"REGISTRATIONS" default:"false"`
+	ReservedNames []string `envconfig:"RESERVED_NAMES"`
 }
 
 var (
@@ -44,18 +50,10 @@ func main() {
 
 	s.RelayURL = strings.Replace(s.ServiceURL, "http", "ws", 1)
 
-	// key stuff (needed for the activitypub integration)
-	var seed [4]byte
-	copy(seed[:], []byte(s.Secret))
-	s.PrivateKey, err = litepub.GeneratePrivateKey(seed)
-	if err != nil {
-		log.Fatal().Err(err).Msg("error deriving private key")
-		return
-	}
-	s.PublicKeyPEM, err = litepub.PublicKeyToPEM(&s.PrivateKey.PublicKey)
-	if err != nil {
-		log.Fatal().Err(err).Msg("error deriving public key")
-		return
+	// the secret is used to derive the nostr keys of pub actors, it can't be
+	// replaced without changing them, so a short one is only a warning
+	if len(s.Secret) < 32 {
+		log.Warn().Msg("SECRET has less than 32 characters, new deployments should use a longer one")
 	}
 
 	// logger
@@ -75,6 +73,10 @@ func main() {
 		pg.Exec("DELETE FROM cache WHERE expiration < now()")
 	}()
 
+	// push new notes to pub followers
+	go watchFollowedPubkeys()
+	go processDeliveries()
+
 	// define routes
 	relayer.Router.Path("/icon.svg").Methods("GET").HandlerFunc(
 		func(w http.ResponseWriter, r *http.Request) {
@@ -83,14 +85,22 @@ func main() {
 			return
 		})
 
+	// pubkeys and ids can be hex or NIP-19
+	pubkeyVar := "{pubkey:[A-Fa-f0-9]{64}|npub1[a-z0-9]+|nprofile1[a-z0-9]+}"
+	idVar := "{id:[A-Fa-f0-9]{64}|note1[a-z0-9]+|nevent1[a-z0-9]+}"
+
 	relayer.Router.Path("/pub").Methods("POST").HandlerFunc(pubInbox)
-	relayer.Router.Path("/pub/user/{pubkey:[A-Fa-f0-9]{64}}").Methods("GET").HandlerFunc(pubUserActor)
-	relayer.Router.Path("/pub/user/{pubkey:[A-Fa-f0-9]{64}}/following").Methods("GET").HandlerFunc(pubUserFollowing)
-	relayer.Router.Path("/pub/user/{pubkey:[A-Fa-f0-9]{64}}/followers").Methods("GET").HandlerFunc(pubUserFollowers)
-	relayer.Router.Path("/pub/user/{pubkey:[A-Fa-f0-9]{64}}/outbox").Methods("GET").HandlerFunc(pubOutbox)
-	relayer.Router.Path("/pub/note/{id:[A-Fa-f0-9]{64}}").Methods("GET").HandlerFunc(pubNote)
+	relayer.Router.Path("/pub/user/" + pubkeyVar).Methods("GET").HandlerFunc(pubUserActor)
+	relayer.Router.Path("/pub/user/" + pubkeyVar + "/following").Methods("GET").HandlerFunc(pubUserFollowing)
+	relayer.Router.Path("/pub/user/" + pubkeyVar + "/followers").Methods("GET").HandlerFunc(pubUserFollowers)
+	relayer.Router.Path("/pub/user/" + pubkeyVar + "/outbox").Methods("GET").HandlerFunc(pubOutbox)
+	relayer.Router.Path("/pub/note/" + idVar).Methods("GET").HandlerFunc(pubNote)
+	relayer.Router.Path("/pub/tag/{name}").Methods("GET").HandlerFunc(pubTag)
 	relayer.Router.Path("/.well-known/webfinger").HandlerFunc(webfinger)
 	relayer.Router.Path("/.well-known/nostr.json").HandlerFunc(handleNip05)
+	relayer.Router.Path("/names").Methods("POST", "DELETE").HandlerFunc(handleNameRegistration)
+
+	relayer.Router.Path("/" + pubkeyVar).Methods("GET").HandlerFunc(redirectToProfile)
 
 	relayer.Router.PathPrefix("/").Methods("GET").Handler(http.FileServer(http.Dir("./static")))
 
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/nbd-wtf/go-nostr"
+	"golang.org/x/exp/slices"
+)
+
+var (
+	validName     = regexp.MustCompile(`^[a-z0-9._-]{1,30}$`)
+	reservedNames = []string{
+		"_", "admin", "administrator", "root", "system", "support", "help", "abuse",
+		"postmaster", "webmaster", "hostmaster", "security", "info", "noreply",
+		"pub", "relay", "nostr", "api", "static", "www", "names", "well-known",
+	}
+)
+
+// nameForPubkey returns the name registered by a nostr pubkey on our domain.
+func nameForPubkey(pubkey string) (string, bool) {
+	var name string
+	if err := pg.Get(&name, "SELECT name FROM names WHERE nostr_pubkey = $1", pubkey); err != nil {
+		return "", false
+	}
+	return name, true
+}
+
+// pubkeyForName is the reverse of nameForPubkey.
+func pubkeyForName(name string) (string, bool) {
+	var pubkey string
+	if err := pg.Get(&pubkey, "SELECT nostr_pubkey FROM names WHERE name = $1", strings.ToLower(name)); err != nil {
+		return "", false
+	}
+	return pubkey, true
+}
+
+// localUsername is what identifies a nostr pubkey on our domain, the name they
+// have registered or just the pubkey.
+func localUsername(pubkey string) string {
+	if name, ok := nameForPubkey(pubkey); ok {
+		return name
+	}
+	return pubkey
+}
+
+var (
+	nameOwner    = pubkeyForName // replaced in tests
+	errNameTaken = fmt.Errorf("name is taken")
+)
+
+// checkName tells why a pubkey can't register a name, if it can't.
+func checkName(name string, pubkey string) error {
+	switch {
+	case !validName.MatchString(name):
+		return fmt.Errorf("names must have up to 30 characters among a-z, 0-9, '.', '-' and '_'")
+	case strings.Contains(name, "_at_"):
+		return fmt.Errorf("names can't contain '_at_', that is for pub actors")
+	case strings.HasPrefix(name, "npub1"), strings.HasPrefix(name, "nprofile1"):
+		return fmt.Errorf("names can't look like pubkeys")
+	case slices.Contains(reservedNames, name), slices.Contains(s.ReservedNames, name):
+		return fmt.Errorf("'%s' is reserved", name)
+	}
+	if owner, ok := nameOwner(name); ok && owner != pubkey {
+		return errNameTaken
+	}
+	return nil
+}
+
+// handleNameRegistration lets nostr users claim a name (POST /names?name=alice)
+// or give it up (DELETE /names). requests are authenticated with NIP-98.
+func handleNameRegistration(w http.ResponseWriter, r *http.Request) {
+	if !s.Registrations {
+		http.Error(w, "registrations are closed", 403)
+		return
+	}
+
+	pubkey, err := verifyNip98(r)
+	if err != nil {
+		http.Error(w, "unauthorized: "+err.Error(), 401)
+		return
+	}
+
+	if r.Method == "DELETE" {
+		if _, err := pg.Exec("DELETE FROM names WHERE nostr_pubkey = $1", pubkey); err != nil {
+			log.Warn().Err(err).Str("pubkey", pubkey).Msg("failed to delete name")
+			http.Error(w, "failed to delete name", 500)
+			return
+		}
+		w.WriteHeader(204)
+		return
+	}
+
+	name := strings.ToLower(r.URL.Query().Get("name"))
+	if err := checkName(name, pubkey); err == errNameTaken {
+		http.Error(w, "name '"+name+"' is taken", 409)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	// each pubkey has just one name, claiming another replaces it
+	res, err := pg.Exec(`
+        INSERT INTO names (name, nostr_pubkey) VALUES ($1, $2)
+        ON CONFLICT (nostr_pubkey) DO UPDATE SET name = EXCLUDED.name, registered_at = now()
+        WHERE NOT EXISTS (SELECT 1 FROM names WHERE name = $1)
+    `, name, pubkey)
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+		// the name is taken by someone else
+		http.Error(w, "name '"+name+"' is taken", 409)
+		return
+	} else if err != nil {
+		log.Warn().Err(err).Str("name", name).Str("pubkey", pubkey).Msg("failed to register name")
+		http.Error(w, "failed to register name", 500)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		if owner, _ := pubkeyForName(name); owner != pubkey {
+			http.Error(w, "name '"+name+"' is taken", 409)
+			return
+		}
+	}
+
+	log.Info().Str("name", name).Str("pubkey", pubkey).Msg("registered name")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"name":   name,
+		"nip05":  name + "@" + serviceHost(),
+		"pubkey": pubkey,
+	})
+}
+
+// verifyNip98 checks the "Authorization: Nostr <base64 event>" header and returns
+// the pubkey that signed it.
+func verifyNip98(r *http.Request) (string, error) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Nostr ") {
+		return "", fmt.Errorf("missing 'Authorization: Nostr' header")
+	}
+
+	b, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(auth, "Nostr "))
+	if err != nil {
+		return "", fmt.Errorf("invalid base64: %w", err)
+	}
+
+	var evt nostr.Event
+	if err := json.Unmarshal(b, &evt); err != nil {
+		return "", fmt.Errorf("invalid event: %w", err)
+	}
+
+	if evt.Kind != 27235 {
+		return "", fmt.Errorf("event must be kind 27235")
+	}
+	if ok, err := evt.CheckSignature(); err != nil || !ok {
+		return "", fmt.Errorf("invalid signature")
+	}
+	if since := time.Since(evt.CreatedAt); since > time.Minute || since < -time.Minute {
+		return "", fmt.Errorf("event is too old or too new")
+	}
+
+	u := evt.Tags.GetFirst([]string{"u", ""})
+	if u == nil || u.Value() != s.ServiceURL+r.URL.RequestURI() {
+		return "", fmt.Errorf("'u' tag must be %s", s.ServiceURL+r.URL.RequestURI())
+	}
+	method := evt.Tags.GetFirst([]string{"method", ""})
+	if method == nil || method.Value() != r.Method {
+		return "", fmt.Errorf("'method' tag must be %s", r.Method)
+	}
+
+	return evt.PubKey, nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestCheckName(t *testing.T) {
+	defer func(previous Settings) { s = previous }(s)
+	s.ReservedNames = []string{"fiatjaf"}
+
+	alice := strings.Repeat("a", 64)
+	bob := strings.Repeat("b", 64)
+	previous := nameOwner
+	nameOwner = func(name string) (string, bool) {
+		if name == "alice" {
+			return alice, true
+		}
+		return "", false
+	}
+	defer func() { nameOwner = previous }()
+
+	tests := []struct {
+		name   string
+		pubkey string
+		err    string
+	}{
+		{"bob", bob, ""},
+		{"bob.smith-2_", bob, ""},
+		{"alice", alice, ""},
+		{"alice", bob, "taken"},
+		{"", bob, "up to 30 characters"},
+		{"Bob", bob, "up to 30 characters"},
+		{"bob smith", bob, "up to 30 characters"},
+		{strings.Repeat("b", 31), bob, "up to 30 characters"},
+		{"bob_at_mastodon.social", bob, "'_at_'"},
+		{"npub1sn0wdenkukak0d9dfczzeacvhkrgz92ak56egt7vdgzn8pv2wfqqhrjdv9", bob, "up to 30 characters"},
+		{"npub1sn0wdenkukak0d9d", bob, "look like pubkeys"},
+		{"nprofile1qqsrhuxx8l9ex", bob, "look like pubkeys"},
+		{"admin", bob, "reserved"},
+		{"well-known", bob, "reserved"},
+		{"fiatjaf", bob, "reserved"},
+	}
+
+	for _, test := range tests {
+		err := checkName(test.name, test.pubkey)
+		if test.err == "" {
+			if err != nil {
+				t.Errorf("%q: unexpected error: %v", test.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%q: expected error containing %q, got %v", test.name, test.err, err)
+		}
+	}
+}
+
+func TestVerifyNip98(t *testing.T) {
+	defer func(previous Settings) { s = previous }(s)
+	s.ServiceURL = "https://bridge.example.com"
+
+	sk := nostr.GeneratePrivateKey()
+	pubkey, _ := nostr.GetPublicKey(sk)
+
+	auth := func(modify func(evt *nostr.Event)) string {
+		evt := nostr.Event{
+			PubKey:    pubkey,
+			CreatedAt: time.Now(),
+			Kind:      27235,
+			Tags: nostr.Tags{
+				{"u", "https://bridge.example.com/names?name=alice"},
+				{"method", "POST"},
+			},
+		}
+		modify(&evt)
+		evt.Sign(sk)
+		b, _ := json.Marshal(evt)
+		return "Nostr " + base64.StdEncoding.EncodeToString(b)
+	}
+
+	tests := []struct {
+		name string
+		auth string
+		err  string
+	}{
+		{"valid", auth(func(evt *nostr.Event) {}), ""},
+		{"no header", "", "missing"},
+		{"not base64", "Nostr %%%", "base64"},
+		{"not an event", "Nostr " + base64.StdEncoding.EncodeToString([]byte("[]")), "invalid event"},
+		{"wrong kind", auth(func(evt *nostr.Event) { evt.Kind = 1 }), "kind 27235"},
+		{"stale", auth(func(evt *nostr.Event) { evt.CreatedAt = time.Now().Add(-5 * time.Minute) }), "too old"},
+		{"from the future", auth(func(evt *nostr.Event) { evt.CreatedAt = time.Now().Add(5 * time.Minute) }), "too new"},
+		{"wrong u", auth(func(evt *nostr.Event) {
+			evt.Tags[0] = nostr.Tag{"u", "https://bridge.example.com/names?name=bob"}
+		}), "'u' tag"},
+		{"u on another host", auth(func(evt *nostr.Event) {
+			evt.Tags[0] = nostr.Tag{"u", "https://evil.example.com/names?name=alice"}
+		}), "'u' tag"},
+		{"no u", auth(func(evt *nostr.Event) { evt.Tags = evt.Tags[1:] }), "'u' tag"},
+		{"wrong method", auth(func(evt *nostr.Event) { evt.Tags[1] = nostr.Tag{"method", "DELETE"} }), "'method' tag"},
+		{"no method", auth(func(evt *nostr.Event) { evt.Tags = evt.Tags[0:1] }), "'method' tag"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/names?name=alice", nil)
+			if test.auth != "" {
+				r.Header.Set("Authorization", test.auth)
+			}
+
+			got, err := verifyNip98(r)
+			if test.err == "" {
+				if err != nil || got != pubkey {
+					t.Fatalf("expected %s, got %s (%v)", pubkey, got, err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("expected error containing %q, got %v", test.err, err)
+			}
+		})
+	}
+
+	// a signature that doesn't match
+	r := httptest.NewRequest("POST", "/names?name=alice", nil)
+	forged := auth(func(evt *nostr.Event) {})
+	b, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(forged, "Nostr "))
+	var evt nostr.Event
+	json.Unmarshal(b, &evt)
+	evt.PubKey = strings.Repeat("c", 64)
+	b, _ = json.Marshal(evt)
+	r.Header.Set("Authorization", "Nostr "+base64.StdEncoding.EncodeToString(b))
+	if _, err := verifyNip98(r); err == nil || !strings.Contains(err.Error(), "signature") {
+		t.Fatalf("expected an invalid signature, got %v", err)
+	}
+}
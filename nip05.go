@@ -37,8 +37,12 @@ func handleNip05(w http.ResponseWriter, r *http.Request) {
 			_, pubkey := nostrKeysForPubActor(actor)
 
 			response.Names[name] = pubkey
-			response.Relays[name] = []string{s.RelayURL}
+			response.Relays[pubkey] = []string{s.RelayURL}
 		}
+	} else if pubkey, ok := pubkeyForName(name); ok {
+		// a nostr user who registered a name with us
+		response.Names[strings.ToLower(name)] = pubkey
+		response.Relays[pubkey] = []string{s.RelayURL}
 	}
 
 	json.NewEncoder(w).Encode(response)
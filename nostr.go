@@ -3,13 +3,16 @@ package main
 import (
 	"context"
 	"math/rand"
+	"net"
+	"net/url"
+	"sync/atomic"
 	"time"
 
 	"github.com/nbd-wtf/go-nostr"
 )
 
 var (
-	ridx      = 0
+	ridx      uint64 // used from many goroutines, see nextRelay
 	allRelays = []string{
 		"wss://nostr-pub.wellorder.net",
 		"wss://nostr-relay.freeberty.net",
@@ -44,14 +47,68 @@ var _ = func() error {
 	return nil
 }()
 
-func querySync(filter nostr.Filter, max int) []nostr.Event {
+// nextRelay takes turns between our relays.
+func nextRelay() string {
+	return allRelays[atomic.AddUint64(&ridx, 1)%uint64(n)]
+}
+
+// maxRelayHints is how many of the relays that come in an nprofile or nevent we
+// try, each of them may take a while to answer.
+const maxRelayHints = 2
+
+var lookupIP = func(host string) ([]net.IP, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	return net.DefaultResolver.LookupIP(ctx, "ip", host)
+}
+
+// relayHints keeps the relays from an nprofile or nevent that we are willing to
+// connect to. these come from anyone, so only the first few are looked at and
+// only public wss:// relays are taken.
+func relayHints(relays []string) []string {
+	if len(relays) > maxRelayHints {
+		relays = relays[0:maxRelayHints]
+	}
+
+	hints := make([]string, 0, len(relays))
+	for _, relay := range relays {
+		parsed, err := url.Parse(relay)
+		if err != nil || parsed.Scheme != "wss" || parsed.Hostname() == "" {
+			continue
+		}
+		ips, err := lookupIP(parsed.Hostname())
+		if err != nil || len(ips) == 0 {
+			continue
+		}
+		public := true
+		for _, ip := range ips {
+			if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+				ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsMulticast() {
+				public = false
+				break
+			}
+		}
+		if public {
+			hints = append(hints, relay)
+		}
+	}
+	return hints
+}
+
+// querySync asks 4 of our relays for the events matching a filter, trying first
+// the extra relays given (like the hints that come in an nprofile or nevent).
+func querySync(filter nostr.Filter, max int, extraRelays ...string) []nostr.Event {
 	ctx := context.Background()
 	events := make([]nostr.Event, 0, max)
 
-	for i := 0; i < 4; i++ {
-		ridx = ridx + 1
+	for i := 0; i < 4+len(extraRelays); i++ {
+		var url string
+		if i < len(extraRelays) {
+			url = extraRelays[i]
+		} else {
+			url = nextRelay()
+		}
 
-		url := allRelays[ridx%n]
 		subctx, cancel := context.WithTimeout(ctx, 2*time.Second)
 		defer cancel()
 
@@ -77,3 +134,41 @@ func querySync(filter nostr.Filter, max int) []nostr.Event {
 
 	return events
 }
+
+// findEvent looks for an event in our store, in our cache and then in other relays.
+func findEvent(id string, extraRelays ...string) *nostr.Event {
+	if events, err := queryEvents(nostr.Filter{IDs: []string{id}, Limit: 1}); err == nil && len(events) > 0 {
+		return &events[0]
+	}
+
+	if evt := getCachedNote(id); evt != nil {
+		return evt
+	}
+
+	if events := querySync(nostr.Filter{IDs: []string{id}}, 1, extraRelays...); len(events) > 0 {
+		go cacheEvent(events[0])
+		return &events[0]
+	}
+
+	return nil
+}
+
+// findMetadata is like findEvent, but for the set_metadata event of a pubkey.
+func findMetadata(pubkey string, extraRelays ...string) *nostr.Event {
+	// what we have stored is always the newest we've seen, the cache may not be
+	filter := nostr.Filter{Authors: []string{pubkey}, Kinds: []int{0}, Limit: 1}
+	if events, err := queryEvents(filter); err == nil && len(events) > 0 {
+		return &events[0]
+	}
+
+	if evt := getCachedMetadata(pubkey); evt != nil {
+		return evt
+	}
+
+	if events := querySync(filter, 1, extraRelays...); len(events) > 0 {
+		go cacheEvent(events[0])
+		return &events[0]
+	}
+
+	return nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+// fakeLookupIP resolves hosts from a map instead of asking dns.
+func fakeLookupIP(t *testing.T, hosts map[string]string) {
+	previous := lookupIP
+	lookupIP = func(host string) ([]net.IP, error) {
+		if ip := net.ParseIP(host); ip != nil {
+			return []net.IP{ip}, nil
+		}
+		if addr, ok := hosts[host]; ok {
+			return []net.IP{net.ParseIP(addr)}, nil
+		}
+		return nil, fmt.Errorf("no such host %s", host)
+	}
+	t.Cleanup(func() { lookupIP = previous })
+}
+
+func TestRelayHints(t *testing.T) {
+	fakeLookupIP(t, map[string]string{
+		"relay.example.com": "93.184.216.34",
+		"other.example.com": "93.184.216.35",
+		"third.example.com": "93.184.216.36",
+		"intranet.example":  "10.1.2.3",
+		"metadata.example":  "169.254.169.254",
+		"localhost":         "127.0.0.1",
+		"ipv6.example.com":  "2606:2800:220:1::1",
+		"ipv6local.example": "fd00::1",
+	})
+
+	tests := []struct {
+		name   string
+		relays []string
+		want   []string
+	}{
+		{"public", []string{"wss://relay.example.com"}, []string{"wss://relay.example.com"}},
+		{"public ipv6", []string{"wss://ipv6.example.com/"}, []string{"wss://ipv6.example.com/"}},
+		{"not wss", []string{"ws://relay.example.com", "https://relay.example.com"}, []string{}},
+		{"private", []string{"wss://intranet.example", "wss://ipv6local.example"}, []string{}},
+		{"loopback", []string{"wss://localhost:7447", "wss://127.0.0.1", "wss://[::1]"}, []string{}},
+		{"link local", []string{"wss://metadata.example", "wss://169.254.169.254"}, []string{}},
+		{"unresolvable", []string{"wss://nowhere.example"}, []string{}},
+		{"garbage", []string{"wss://", "::", ""}, []string{}},
+		{
+			"only the first ones are looked at",
+			[]string{"wss://relay.example.com", "wss://intranet.example", "wss://other.example.com", "wss://third.example.com"},
+			[]string{"wss://relay.example.com"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := relayHints(test.relays); !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("expected %v, got %v", test.want, got)
+			}
+		})
+	}
+}
+
+func TestDecodePubkeyRelays(t *testing.T) {
+	fakeLookupIP(t, map[string]string{"relay.example.com": "93.184.216.34"})
+
+	pubkey := strings.Repeat("ab", 32)
+	nprofile, err := nip19.EncodeProfile(pubkey, []string{"ws://relay.example.com", "wss://relay.example.com", "wss://relay.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, relays, ok := decodePubkey(nprofile)
+	if !ok || decoded != pubkey {
+		t.Fatalf("failed to decode %s", nprofile)
+	}
+	if !reflect.DeepEqual(relays, []string{"wss://relay.example.com"}) {
+		t.Fatalf("unexpected relays %v", relays)
+	}
+
+	nevent, err := nip19.EncodeEvent(pubkey, []string{"wss://10.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, relays, ok := decodeEventId(nevent); !ok || id != pubkey || len(relays) != 0 {
+		t.Fatalf("unexpected %s %v %v", id, relays, ok)
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fiatjaf/litepub"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// pollOptions returns the options of a Question and whether more than one of
+// them can be chosen.
+func (note Note) pollOptions() ([]PollOption, bool) {
+	if len(note.AnyOf) > 0 {
+		return note.AnyOf, true
+	}
+	return note.OneOf, false
+}
+
+// closedAt returns when a Question was closed, if it was.
+func (note Note) closedAt() (time.Time, bool) {
+	switch closed := note.Closed.(type) {
+	case string:
+		if t, err := time.Parse(time.RFC3339, closed); err == nil {
+			return t, true
+		}
+	case bool:
+		if !closed {
+			return time.Time{}, false
+		}
+		if note.EndTime != nil {
+			return *note.EndTime, true
+		}
+		return time.Now(), true
+	}
+	return time.Time{}, false
+}
+
+// pollLines lists the options of a poll for the content of the kind-1 note, for
+// clients that don't know about polls.
+func pollLines(options []PollOption) string {
+	lines := make([]string, len(options))
+	for i, option := range options {
+		lines[i] = "- " + option.Name
+	}
+	return strings.Join(lines, "\n")
+}
+
+// nostrPollFromPub returns the tags of the NIP-88 poll (kind 1068) for a Question,
+// or nil if it has no options.
+func nostrPollFromPub(note *Note) nostr.Tags {
+	options, multiple := note.pollOptions()
+	if len(options) == 0 {
+		return nil
+	}
+
+	polltype := "singlechoice"
+	if multiple {
+		polltype = "multiplechoice"
+	}
+	tags := nostr.Tags{{"polltype", polltype}}
+
+	for i, option := range options {
+		tags = append(tags, nostr.Tag{"option", strconv.Itoa(i), option.Name})
+	}
+	if note.EndTime != nil {
+		tags = append(tags, nostr.Tag{"endsAt", strconv.FormatInt(note.EndTime.Unix(), 10)})
+	}
+	tags = append(tags, nostr.Tag{"relay", s.RelayURL})
+
+	return tags
+}
+
+// nostrPollEventFromPub creates the NIP-88 poll that goes along with the kind-1
+// note made by nostrEventFromPubNote for a Question. it points to that note, which
+// is the one pub knows about, and has the question without the options as content.
+func nostrPollEventFromPub(note *Note, rendered nostr.Event) (nostr.Event, bool) {
+	pollTags := nostrPollFromPub(note)
+	if pollTags == nil {
+		return nostr.Event{}, false
+	}
+	options, _ := note.pollOptions()
+	lines := pollLines(options)
+	if strings.Contains(rendered.Content, "\n\n"+lines) {
+		lines = "\n\n" + lines
+	}
+
+	privkey, pubkey := nostrKeysForPubActor(note.AttributedTo)
+
+	evt := nostr.Event{
+		CreatedAt: rendered.CreatedAt,
+		PubKey:    pubkey,
+		Tags:      append(nostr.Tags{{"e", rendered.ID, s.RelayURL, "mention"}}, pollTags...),
+		Kind:      1068,
+		Content:   strings.TrimSpace(strings.Replace(rendered.Content, lines, "", 1)),
+	}
+
+	if err := evt.Sign(privkey); err != nil {
+		log.Warn().Err(err).Interface("evt", evt).Msg("fail to sign an event")
+	}
+
+	return evt, true
+}
+
+// nostrPollResultsFromPub creates a reply to a closed Question with how many votes
+// each option got.
+func nostrPollResultsFromPub(note *Note) (nostr.Event, error) {
+	closedAt, closed := note.closedAt()
+	if !closed {
+		return nostr.Event{}, fmt.Errorf("poll '%s' is not closed", note.Id)
+	}
+
+	question, ok := nostrEventIdForPubObject(note.Id)
+	if !ok {
+		question = nostrEventFromPubNote(note).ID
+	}
+
+	options, _ := note.pollOptions()
+	lines := make([]string, len(options))
+	for i, option := range options {
+		lines[i] = fmt.Sprintf("- %s: %d", option.Name, option.votes())
+	}
+
+	privkey, pubkey := nostrKeysForPubActor(note.AttributedTo)
+
+	evt := nostr.Event{
+		CreatedAt: closedAt,
+		PubKey:    pubkey,
+		Tags:      nostr.Tags{{"e", question, s.RelayURL, "reply"}},
+		Kind:      1,
+		Content:   "Poll results:\n" + strings.Join(lines, "\n"),
+	}
+
+	if err := evt.Sign(privkey); err != nil {
+		return evt, fmt.Errorf("failed to sign poll results: %w", err)
+	}
+
+	return evt, nil
+}
+
+// pubVotesFromNostrEvent turns a NIP-88 poll response (kind 1018) into the Notes
+// the fediverse uses as votes, one for each chosen option, only for polls that
+// came from pub.
+func pubVotesFromNostrEvent(event nostr.Event) ([]litepub.Create[Note], string, bool) {
+	target := event.Tags.GetFirst([]string{"e", ""})
+	if target == nil {
+		return nil, "", false
+	}
+
+	poll := findEvent(target.Value())
+	if poll == nil || poll.Kind != 1068 {
+		return nil, "", false
+	}
+
+	// the poll points to the note that stands for the Question
+	rendered := poll.Tags.GetFirst([]string{"e", ""})
+	if rendered == nil {
+		return nil, "", false
+	}
+	var questionUrl string
+	if err := pg.Get(&questionUrl, "SELECT pub_note_url FROM notes WHERE nostr_event_id = $1", rendered.Value()); err != nil {
+		return nil, "", false
+	}
+	if question := findEvent(rendered.Value()); question == nil || question.PubKey != poll.PubKey {
+		return nil, "", false
+	}
+
+	author := pubNoteAuthor(rendered.Value(), questionUrl)
+	if author == "" {
+		return nil, "", false
+	}
+
+	votes := pubVotesForPoll(event, *poll, questionUrl, author)
+	return votes, author, len(votes) > 0
+}
+
+// pubVotesForPoll makes the votes for the options chosen in a poll response.
+func pubVotesForPoll(event nostr.Event, poll nostr.Event, questionUrl string, author string) []litepub.Create[Note] {
+	options := make(map[string]string)
+	for _, tag := range poll.Tags.GetAll([]string{"option", ""}) {
+		if len(tag) >= 3 {
+			options[tag[1]] = tag[2]
+		}
+	}
+
+	// only the first response counts on single choice polls
+	responses := event.Tags.GetAll([]string{"response", ""})
+	if polltype := poll.Tags.GetFirst([]string{"polltype", ""}); (polltype == nil ||
+		polltype.Value() != "multiplechoice") && len(responses) > 1 {
+		responses = responses[0:1]
+	}
+
+	var votes []litepub.Create[Note]
+	for _, response := range responses {
+		name, ok := options[response.Value()]
+		if !ok {
+			continue
+		}
+
+		id := event.ID + "/" + response.Value()
+		vote := Note{
+			Note: litepub.Note{
+				Base: litepub.Base{
+					Id:   s.ServiceURL + "/pub/vote/" + id,
+					Type: "Note",
+				},
+				Published:    event.CreatedAt,
+				AttributedTo: s.ServiceURL + "/pub/user/" + event.PubKey,
+				InReplyTo:    questionUrl,
+				To:           []string{author},
+			},
+			InReplyTo: questionUrl,
+			Name:      name,
+		}
+		votes = append(votes, wrapCreate(vote, s.ServiceURL+"/pub/create/"+id))
+	}
+
+	return votes
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestNostrPollFromPub(t *testing.T) {
+	tests := []struct {
+		name     string
+		question string
+		want     nostr.Tags
+	}{
+		{
+			name: "single choice",
+			question: `{"type":"Question","content":"<p>tea or coffee?</p>","endTime":"2023-06-02T00:00:00Z",
+				"oneOf":[{"type":"Note","name":"tea","replies":{"totalItems":3}},{"type":"Note","name":"coffee"}]}`,
+			want: nostr.Tags{
+				{"polltype", "singlechoice"},
+				{"option", "0", "tea"},
+				{"option", "1", "coffee"},
+				{"endsAt", "1685664000"},
+				{"relay", s.RelayURL},
+			},
+		},
+		{
+			name: "multiple choice",
+			question: `{"type":"Question","content":"<p>which ones?</p>",
+				"anyOf":[{"type":"Note","name":"a"},{"type":"Note","name":"b"}]}`,
+			want: nostr.Tags{
+				{"polltype", "multiplechoice"},
+				{"option", "0", "a"},
+				{"option", "1", "b"},
+				{"relay", s.RelayURL},
+			},
+		},
+		{
+			name:     "not a poll",
+			question: `{"type":"Note","content":"<p>hello</p>"}`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var note Note
+			if err := json.Unmarshal([]byte(test.question), &note); err != nil {
+				t.Fatal(err)
+			}
+			if got := nostrPollFromPub(&note); !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("expected %v, got %v", test.want, got)
+			}
+		})
+	}
+}
+
+func TestPubVotesForPoll(t *testing.T) {
+	poll := func(polltype string) nostr.Event {
+		return nostr.Event{Kind: 1068, Tags: nostr.Tags{
+			{"polltype", polltype},
+			{"option", "0", "tea"},
+			{"option", "1", "coffee"},
+			{"option", "2", "water"},
+		}}
+	}
+	response := func(options ...string) nostr.Event {
+		evt := nostr.Event{Kind: 1018, PubKey: strings.Repeat("a", 64), Tags: nostr.Tags{{"e", strings.Repeat("b", 64)}}}
+		for _, option := range options {
+			evt.Tags = append(evt.Tags, nostr.Tag{"response", option})
+		}
+		evt.ID = evt.GetID()
+		return evt
+	}
+
+	tests := []struct {
+		name     string
+		poll     nostr.Event
+		response nostr.Event
+		want     []string
+	}{
+		{"single choice", poll("singlechoice"), response("1"), []string{"coffee"}},
+		{"single choice with many answers", poll("singlechoice"), response("2", "0"), []string{"water"}},
+		{"no polltype is single choice", poll(""), response("0", "1"), []string{"tea"}},
+		{"multiple choice", poll("multiplechoice"), response("0", "2"), []string{"tea", "water"}},
+		{"unknown option", poll("multiplechoice"), response("7", "1"), []string{"coffee"}},
+		{"nothing chosen", poll("singlechoice"), response(), nil},
+	}
+
+	questionUrl := "https://mastodon.example.com/users/alice/statuses/1"
+	author := "https://mastodon.example.com/users/alice"
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var got []string
+			for _, vote := range pubVotesForPoll(test.response, test.poll, questionUrl, author) {
+				if vote.Object.InReplyTo != questionUrl || vote.Object.To[0] != author ||
+					vote.Object.AttributedTo != s.ServiceURL+"/pub/user/"+test.response.PubKey {
+					t.Fatalf("vote isn't addressed to the question: %+v", vote.Object)
+				}
+				got = append(got, vote.Object.Name)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("expected %v, got %v", test.want, got)
+			}
+		})
+	}
+}
+
+func TestPollLines(t *testing.T) {
+	options := []PollOption{{Name: "tea"}, {Name: "coffee"}}
+	if got := pollLines(options); got != "- tea\n- coffee" {
+		t.Fatalf("unexpected options %q", got)
+	}
+}
@@ -20,21 +20,58 @@ CREATE TABLE IF NOT EXISTS keys (
   nostr_pubkey text PRIMARY KEY
 );
 
+-- rsa keys of the pub actors that represent nostr pubkeys
+CREATE TABLE IF NOT EXISTS actor_keys (
+  nostr_pubkey text PRIMARY KEY,
+  private_key text NOT NULL
+);
+
 -- pub profiles that are following nostr pubkeys
 CREATE TABLE IF NOT EXISTS followers (
   nostr_pubkey text NOT NULL,
   pub_actor_url text NOT NULL,
+  inbox text NOT NULL DEFAULT '',
+  shared_inbox text NOT NULL DEFAULT '',
 
   UNIQUE(nostr_pubkey, pub_actor_url)
 );
+ALTER TABLE followers ADD COLUMN IF NOT EXISTS inbox text NOT NULL DEFAULT '';
+ALTER TABLE followers ADD COLUMN IF NOT EXISTS shared_inbox text NOT NULL DEFAULT '';
 CREATE INDEX IF NOT EXISTS pubfollowersidx ON followers (nostr_pubkey);
+CREATE INDEX IF NOT EXISTS pubactorkeysidx ON keys (pub_actor_url);
+
+-- pub actors followed by nostr pubkeys through their contact lists
+CREATE TABLE IF NOT EXISTS following (
+  nostr_pubkey text NOT NULL,
+  pub_actor_url text NOT NULL,
+  follow_id text NOT NULL,
+  status text NOT NULL DEFAULT 'pending',
+  followed_at timestamp NOT NULL DEFAULT now(),
+
+  UNIQUE(nostr_pubkey, pub_actor_url)
+);
+ALTER TABLE following ADD COLUMN IF NOT EXISTS followed_at timestamp NOT NULL DEFAULT now();
+CREATE INDEX IF NOT EXISTS followingidx ON following (follow_id);
 
--- reverse map of nostr event ids to pub notes
+-- reverse map of nostr event ids to pub notes (and likes)
 CREATE TABLE IF NOT EXISTS notes (
   pub_note_url text NOT NULL,
   nostr_event_id text PRIMARY KEY
 );
 
+-- nostr events that were deleted, so pub servers can be told they are gone
+CREATE TABLE IF NOT EXISTS tombstones (
+  nostr_event_id text PRIMARY KEY,
+  nostr_pubkey text NOT NULL,
+  deleted_at timestamp NOT NULL DEFAULT now()
+);
+
+-- when pub servers were last asked about something, see refreshFromPub
+CREATE TABLE IF NOT EXISTS refreshes (
+  key text PRIMARY KEY,
+  refreshed_at timestamp NOT NULL
+);
+
 -- event cache
 CREATE TABLE IF NOT EXISTS cache (
   key text PRIMARY KEY,
@@ -45,6 +82,50 @@ CREATE TABLE IF NOT EXISTS cache (
 CREATE INDEX IF NOT EXISTS prefixmatch ON cache(key text_pattern_ops);
 CREATE INDEX IF NOT EXISTS cachedeventorder ON cache (time);
 
+-- nostr events bridged from pub and published to our relay
+CREATE TABLE IF NOT EXISTS events (
+  id text PRIMARY KEY,
+  pubkey text NOT NULL,
+  created_at integer NOT NULL,
+  kind integer NOT NULL,
+  tags jsonb NOT NULL,
+  content text NOT NULL,
+  sig text NOT NULL
+);
+CREATE INDEX IF NOT EXISTS eventsidprefix ON events (id text_pattern_ops);
+CREATE INDEX IF NOT EXISTS eventspubkeyprefix ON events (pubkey text_pattern_ops);
+CREATE INDEX IF NOT EXISTS eventsorder ON events (created_at DESC);
+CREATE INDEX IF NOT EXISTS eventskind ON events (kind);
+CREATE INDEX IF NOT EXISTS eventstags ON events USING gin (tags);
+
+-- outgoing pub activities waiting to be delivered
+CREATE TABLE IF NOT EXISTS deliveries (
+  activity_id text NOT NULL,
+  inbox text NOT NULL,
+  nostr_pubkey text NOT NULL,
+  activity text NOT NULL,
+  attempts integer NOT NULL DEFAULT 0,
+  next_attempt timestamp NOT NULL DEFAULT now(),
+  last_error text,
+
+  UNIQUE(activity_id, inbox)
+);
+CREATE INDEX IF NOT EXISTS deliveriesorder ON deliveries (next_attempt);
+
+-- pub inboxes we failed to deliver to
+CREATE TABLE IF NOT EXISTS inboxes (
+  url text PRIMARY KEY,
+  failures integer NOT NULL DEFAULT 0,
+  dead boolean NOT NULL DEFAULT false
+);
+
+-- name@our-domain identifiers claimed by nostr pubkeys
+CREATE TABLE IF NOT EXISTS names (
+  name text PRIMARY KEY,
+  nostr_pubkey text UNIQUE NOT NULL,
+  registered_at timestamp NOT NULL DEFAULT now()
+);
+
 -- TODO: map of actual nostr pubkeys to relays and of nostr event ids to relays
     `)
 	if err != nil {
@@ -3,9 +3,13 @@ package main
 import (
 	"database/sql"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"net/http"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/fiatjaf/litepub"
 	"github.com/gorilla/mux"
@@ -14,21 +18,23 @@ import (
 )
 
 func pubUserActor(w http.ResponseWriter, r *http.Request) {
-	pubkey := mux.Vars(r)["pubkey"]
+	pubkey, relays, ok := decodePubkey(mux.Vars(r)["pubkey"])
+	if !ok {
+		http.Error(w, "invalid pubkey", 404)
+		return
+	}
 	log.Debug().Str("pubkey", pubkey).Msg("got pub actor request")
 
-	// try to get cached set_metadata event
-	var evt *nostr.Event
-	evt = getCachedMetadata(pubkey)
+	evt := findMetadata(pubkey, relays...)
 	if evt == nil {
-		// try to get profile information from relays
-		events := querySync(nostr.Filter{Authors: []string{pubkey}, Kinds: []int{0}}, 1)
-		if len(events) == 0 {
-			http.Error(w, "user not found", 404)
-			return
-		}
-		go cacheEvent(events[0])
-		evt = &events[0]
+		http.Error(w, "user not found", 404)
+		return
+	}
+
+	w.Header().Set("Vary", "Accept")
+	if wantsHTML(r) {
+		renderProfilePage(w, *evt)
+		return
 	}
 
 	actor := pubActorFromNostrEvent(*evt)
@@ -37,54 +43,63 @@ func pubUserActor(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(actor)
 }
 
+// how many items go in each page of our collections
+const pageSize = 40
+
 func pubUserFollowers(w http.ResponseWriter, r *http.Request) {
-	pubkey := mux.Vars(r)["pubkey"]
+	pubkey, _, ok := decodePubkey(mux.Vars(r)["pubkey"])
+	if !ok {
+		http.Error(w, "invalid pubkey", 404)
+		return
+	}
 	log.Debug().Str("pubkey", pubkey).Msg("got followers request")
 
-	var followers []string
-	pg.Select(&followers,
-		`SELECT pub_actor_url FROM followers WHERE nostr_pubkey = $1`,
-		pubkey,
-	)
+	followersUrl := s.ServiceURL + "/pub/user/" + pubkey + "/followers"
 
-	// TODO: also search for kind-3
+	var total int
+	pg.Get(&total, "SELECT count(*) FROM followers WHERE nostr_pubkey = $1", pubkey)
 
-	page := litepub.OrderedCollectionPage[string]{
-		Base: litepub.Base{
-			Type: "OrderedCollectionPage",
-			Id:   s.ServiceURL + "/pub/user/" + pubkey + "/followers?page=1",
-		},
-		PartOf:       s.ServiceURL + "/pub/user/" + pubkey + "/followers",
-		TotalItems:   len(followers),
-		OrderedItems: followers,
-	}
-	jpage, _ := json.Marshal(page)
+	// TODO: also search for kind-3
 
 	w.Header().Set("Content-Type", "application/activity+json")
-	if r.URL.Query().Get("page") != "" {
-		json.NewEncoder(w).Encode(page)
-	} else {
-		collection := litepub.OrderedCollection{
+	n, ok := pageNumber(r)
+	if !ok {
+		json.NewEncoder(w).Encode(OrderedCollection{
 			Base: litepub.Base{
 				Type: "OrderedCollection",
-				Id:   s.ServiceURL + "/pub/user/" + pubkey + "/followers",
+				Id:   followersUrl,
 			},
-			First:      json.RawMessage(jpage),
-			TotalItems: len(followers),
-		}
-		json.NewEncoder(w).Encode(collection)
+			TotalItems: total,
+			First:      followersUrl + "?page=1",
+		})
+		return
 	}
+
+	var followers []string
+	pg.Select(&followers, `
+        SELECT pub_actor_url FROM followers WHERE nostr_pubkey = $1
+        ORDER BY pub_actor_url
+        LIMIT $2 OFFSET $3
+    `, pubkey, pageSize, (n-1)*pageSize)
+
+	json.NewEncoder(w).Encode(numberedPage(followersUrl, n, total, followers))
 }
 
 func pubUserFollowing(w http.ResponseWriter, r *http.Request) {
-	pubkey := mux.Vars(r)["pubkey"]
+	pubkey, relays, ok := decodePubkey(mux.Vars(r)["pubkey"])
+	if !ok {
+		http.Error(w, "invalid pubkey", 404)
+		return
+	}
 	log.Debug().Str("pubkey", pubkey).Msg("got following request")
 
+	followingUrl := s.ServiceURL + "/pub/user/" + pubkey + "/following"
+
 	var evt *nostr.Event
 	evt = getCachedContactList(pubkey)
 	if evt == nil {
 		// try to get contact list from relays
-		events := querySync(nostr.Filter{Authors: []string{pubkey}, Kinds: []int{3}}, 1)
+		events := querySync(nostr.Filter{Authors: []string{pubkey}, Kinds: []int{3}}, 1, relays...)
 		if len(events) != 0 {
 			go cacheEvent(events[0])
 			evt = &events[0]
@@ -100,97 +115,367 @@ func pubUserFollowing(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	page := litepub.OrderedCollectionPage[string]{
+	w.Header().Set("Content-Type", "application/activity+json")
+	n, ok := pageNumber(r)
+	if !ok {
+		json.NewEncoder(w).Encode(OrderedCollection{
+			Base: litepub.Base{
+				Type: "OrderedCollection",
+				Id:   followingUrl,
+			},
+			TotalItems: len(following),
+			First:      followingUrl + "?page=1",
+		})
+		return
+	}
+
+	start := (n - 1) * pageSize
+	if start > len(following) {
+		start = len(following)
+	}
+	end := start + pageSize
+	if end > len(following) {
+		end = len(following)
+	}
+
+	// only now we turn the pubkeys into actors, as that can be slow
+	actors := make([]string, end-start)
+	for i, pubkey := range following[start:end] {
+		actors[i], _ = pubActorURL(pubkey)
+	}
+
+	json.NewEncoder(w).Encode(numberedPage(followingUrl, n, len(following), actors))
+}
+
+// pageNumber reads the ?page= of a request for a collection, ok is false when the
+// collection itself is being requested.
+func pageNumber(r *http.Request) (n int, ok bool) {
+	page := r.URL.Query().Get("page")
+	if page == "" {
+		return 0, false
+	}
+	if n, err := strconv.Atoi(page); err == nil && n > 1 {
+		return n, true
+	}
+	return 1, true
+}
+
+func numberedPage(collectionUrl string, n int, total int, items []string) OrderedCollectionPage[string] {
+	page := OrderedCollectionPage[string]{
 		Base: litepub.Base{
 			Type: "OrderedCollectionPage",
-			Id:   s.ServiceURL + "/pub/user/" + pubkey + "/following?page=1",
+			Id:   fmt.Sprintf("%s?page=%d", collectionUrl, n),
 		},
-		PartOf:       s.ServiceURL + "/pub/user/" + pubkey + "/following",
-		TotalItems:   len(following),
-		OrderedItems: following,
+		PartOf:       collectionUrl,
+		TotalItems:   total,
+		OrderedItems: items,
+	}
+	if n*pageSize < total {
+		page.Next = fmt.Sprintf("%s?page=%d", collectionUrl, n+1)
+	}
+	if n > 1 {
+		page.Prev = fmt.Sprintf("%s?page=%d", collectionUrl, n-1)
+	}
+	return page
+}
+
+// pageCursor marks where a page of events ends. events are ordered by created_at
+// and then by id, so pages don't skip events created in the same second.
+type pageCursor struct {
+	time time.Time
+	id   string
+}
+
+func cursorFor(evt nostr.Event) *pageCursor {
+	return &pageCursor{time: evt.CreatedAt, id: evt.ID}
+}
+
+// parsePageCursor reads the "<created_at>-<id>" values of ?max_id= and ?min_id=.
+func parsePageCursor(value string) *pageCursor {
+	spl := strings.SplitN(value, "-", 2)
+	ts, err := strconv.ParseInt(spl[0], 10, 64)
+	if err != nil {
+		return nil
 	}
-	jpage, _ := json.Marshal(page)
+
+	cursor := &pageCursor{time: time.Unix(ts, 0)}
+	if len(spl) == 2 {
+		cursor.id = spl[1]
+	}
+	return cursor
+}
+
+func (c pageCursor) String() string {
+	return fmt.Sprintf("%d-%s", c.time.Unix(), c.id)
+}
+
+// compare is positive when an event is newer than the cursor, negative when it
+// is older and zero when it is the event at the cursor.
+func (c pageCursor) compare(evt nostr.Event) int {
+	switch {
+	case evt.CreatedAt.Unix() != c.time.Unix():
+		return int(evt.CreatedAt.Unix() - c.time.Unix())
+	case evt.ID > c.id:
+		return 1
+	case evt.ID < c.id:
+		return -1
+	}
+	return 0
+}
+
+// newestFirst sorts events the way pages show them.
+func newestFirst(events []nostr.Event) {
+	sort.Slice(events, func(i, j int) bool {
+		if events[i].CreatedAt.Unix() != events[j].CreatedAt.Unix() {
+			return events[i].CreatedAt.After(events[j].CreatedAt)
+		}
+		return events[i].ID > events[j].ID
+	})
+}
+
+// pageOfEvents takes the events that go in the page after the cursor "after" (newer
+// than it) or before the cursor "before" (older than it) and sorts them newest first.
+// events may come from many places, so they may be repeated.
+func pageOfEvents(events []nostr.Event, after, before *pageCursor) []nostr.Event {
+	page := make([]nostr.Event, 0, len(events))
+	seen := make(map[string]bool, len(events))
+	for _, evt := range events {
+		if seen[evt.ID] {
+			continue
+		}
+		seen[evt.ID] = true
+
+		if after != nil && after.compare(evt) <= 0 {
+			continue
+		}
+		if before != nil && before.compare(evt) >= 0 {
+			continue
+		}
+		page = append(page, evt)
+	}
+
+	newestFirst(page)
+
+	if len(page) > pageSize {
+		if after != nil && before == nil {
+			// the ones right after the cursor
+			page = page[len(page)-pageSize:]
+		} else {
+			page = page[0:pageSize]
+		}
+	}
+	return page
+}
+
+// pubOutbox pages go back in time with ?max_id= and forward with ?min_id=.
+func pubOutbox(w http.ResponseWriter, r *http.Request) {
+	pubkey, relays, ok := decodePubkey(mux.Vars(r)["pubkey"])
+	if !ok {
+		http.Error(w, "invalid pubkey", 404)
+		return
+	}
+	log.Debug().Str("pubkey", pubkey).Msg("got outbox request")
+
+	outboxUrl := s.ServiceURL + "/pub/user/" + pubkey + "/outbox"
+	query := r.URL.Query()
 
 	w.Header().Set("Content-Type", "application/activity+json")
-	if r.URL.Query().Get("page") != "" {
-		json.NewEncoder(w).Encode(page)
-	} else {
-		collection := litepub.OrderedCollection{
+	if query.Get("page") == "" {
+		json.NewEncoder(w).Encode(OrderedCollection{
 			Base: litepub.Base{
 				Type: "OrderedCollection",
-				Id:   s.ServiceURL + "/pub/user/" + pubkey + "/following",
+				Id:   outboxUrl,
 			},
-			First:      json.RawMessage(jpage),
-			TotalItems: len(following),
+			First: outboxUrl + "?page=true",
+		})
+		return
+	}
+
+	after := parsePageCursor(query.Get("min_id"))
+	before := parsePageCursor(query.Get("max_id"))
+	events := outboxEvents(pubkey, relays, after, before)
+
+	activities := make([]any, 0, len(events))
+	for _, evt := range events {
+		if activity, ok := pubActivityFromNostrEvent(evt); ok {
+			activities = append(activities, activity)
 		}
-		json.NewEncoder(w).Encode(collection)
 	}
+
+	json.NewEncoder(w).Encode(cursorPage(outboxUrl, r, events, activities))
 }
 
-func pubOutbox(w http.ResponseWriter, r *http.Request) {
-	pubkey := mux.Vars(r)["pubkey"]
-	log.Debug().Str("pubkey", pubkey).Msg("got outbox request")
+// cursorPage is a page of a collection of events, linking to the pages around it.
+func cursorPage(collectionUrl string, r *http.Request, events []nostr.Event, items []any) OrderedCollectionPage[any] {
+	page := OrderedCollectionPage[any]{
+		Base: litepub.Base{
+			Type: "OrderedCollectionPage",
+			Id:   collectionUrl + "?" + r.URL.RawQuery,
+		},
+		PartOf:       collectionUrl,
+		OrderedItems: items,
+	}
+	if len(events) > 0 {
+		page.Next = collectionUrl + "?page=true&max_id=" + cursorFor(events[len(events)-1]).String()
+		page.Prev = collectionUrl + "?page=true&min_id=" + cursorFor(events[0]).String()
+	}
+	return page
+}
 
-	events := getNotesForPubkey(pubkey)
+// outboxEvents gets a page of notes and reposts from a nostr pubkey, newest first.
+// when going back in time we may not have the events, so we ask the relays, first
+// the ones given (from an nprofile).
+func outboxEvents(pubkey string, relays []string, after, before *pageCursor) []nostr.Event {
+	// the bounds are inclusive and pageOfEvents takes out what is on the other
+	// pages, so we take more than a page
+	filter := nostr.Filter{
+		Kinds:   []int{1, 6},
+		Authors: []string{pubkey},
+		Limit:   pageSize * 2,
+	}
+	if after != nil {
+		filter.Since = &after.time
+	}
+	if before != nil {
+		filter.Until = &before.time
+	}
+	forward := after != nil && before == nil
+
+	events := getNotesForPubkey(pubkey, filter.Since, filter.Until, filter.Limit)
+	if stored, err := queryEventsOrdered(filter, forward); err == nil {
+		events = append(events, stored...)
+	} else {
+		log.Warn().Err(err).Str("pubkey", pubkey).Msg("failed to query stored events")
+	}
 
 	gatherNotes := func() []nostr.Event {
-		evts := querySync(nostr.Filter{Kinds: []int{1}, Authors: []string{pubkey}}, 40)
+		evts := querySync(filter, pageSize, relays...)
 		for _, evt := range evts {
 			go cacheEvent(evt)
 		}
 		return evts
 	}
 
-	if len(events) == 0 {
-		events = gatherNotes()
-	} else {
+	if len(events) < pageSize && after == nil {
+		events = append(events, gatherNotes()...)
+	} else if after == nil && before == nil {
 		go gatherNotes()
 	}
 
-	creates := make([]litepub.Create[litepub.Note], len(events))
-	for i, evt := range events {
-		note := pubNoteFromNostrEvent(evt)
-		creates[i] = litepub.WrapCreate(note, s.ServiceURL+"/pub/create/"+evt.ID)
+	return pageOfEvents(events, after, before)
+}
+
+// pubTag is the collection of recent notes with a hashtag, paged like the outbox.
+func pubTag(w http.ResponseWriter, r *http.Request) {
+	name := strings.ToLower(mux.Vars(r)["name"])
+	log.Debug().Str("tag", name).Msg("got tag request")
+
+	collectionUrl := pubHashtag(name).Href
+	query := r.URL.Query()
+
+	w.Header().Set("Content-Type", "application/activity+json")
+	if query.Get("page") == "" {
+		json.NewEncoder(w).Encode(OrderedCollection{
+			Base: litepub.Base{
+				Type: "OrderedCollection",
+				Id:   collectionUrl,
+			},
+			First: collectionUrl + "?page=true",
+		})
+		return
 	}
 
-	page := litepub.OrderedCollectionPage[litepub.Create[litepub.Note]]{
-		Base: litepub.Base{
-			Type: "OrderedCollectionPage",
-			Id:   s.ServiceURL + "/pub/user/" + pubkey + "/outbox",
-		},
-		PartOf:       s.ServiceURL + "/pub/user/" + pubkey + "/outbox",
-		TotalItems:   len(creates),
-		OrderedItems: creates,
+	after := parsePageCursor(query.Get("min_id"))
+	before := parsePageCursor(query.Get("max_id"))
+
+	filter := nostr.Filter{Kinds: []int{1}, Tags: nostr.TagMap{"t": {name}}, Limit: pageSize * 2}
+	if after != nil {
+		filter.Since = &after.time
+	}
+	if before != nil {
+		filter.Until = &before.time
 	}
-	jpage, _ := json.Marshal(page)
 
-	collection := litepub.OrderedCollection{
-		Base: litepub.Base{
-			Type: "OrderedCollection",
-			Id:   s.ServiceURL + "/pub/user/" + pubkey + "/outbox",
-		},
-		First:      json.RawMessage(jpage),
-		TotalItems: page.TotalItems,
+	events, err := queryEventsOrdered(filter, after != nil && before == nil)
+	if err != nil {
+		log.Warn().Err(err).Str("tag", name).Msg("failed to query tagged events")
+	}
+	if len(events) < pageSize && after == nil {
+		found := querySync(filter, pageSize)
+		for _, evt := range found {
+			go cacheEvent(evt)
+		}
+		events = append(events, found...)
 	}
+	events = pageOfEvents(events, after, before)
 
-	w.Header().Set("Content-Type", "application/activity+json")
-	json.NewEncoder(w).Encode(collection)
+	pubkeys := make([]string, len(events))
+	for i, evt := range events {
+		pubkeys[i] = evt.PubKey
+	}
+	bridged := bridgedPubkeys(pubkeys)
+
+	items := make([]any, 0, len(events))
+	for _, evt := range events {
+		if bridged[evt.PubKey] {
+			// notes that came from pub are linked to, making our own copy of them
+			// would look like it was us who wrote them
+			if noteUrl := pubNoteURL(evt.ID); !strings.HasPrefix(noteUrl, s.ServiceURL) {
+				items = append(items, noteUrl)
+			}
+			continue
+		}
+		note := pubNoteFromNostrEvent(evt)
+		items = append(items, wrapCreate(note, s.ServiceURL+"/pub/create/"+evt.ID))
+	}
+
+	json.NewEncoder(w).Encode(cursorPage(collectionUrl, r, events, items))
 }
 
 func pubNote(w http.ResponseWriter, r *http.Request) {
-	noteId := mux.Vars(r)["id"]
+	eventId, relays, ok := decodeEventId(mux.Vars(r)["id"])
+	if !ok {
+		http.Error(w, "invalid note id", 404)
+		return
+	}
 
-	// it's the same for nostr events
-	eventId := noteId
+	evt := findEvent(eventId, relays...)
 
-	getCachedNote(noteId)
+	var tombstone struct {
+		Pubkey    string    `db:"nostr_pubkey"`
+		DeletedAt time.Time `db:"deleted_at"`
+	}
+	if err := pg.Get(&tombstone, `
+        SELECT nostr_pubkey, deleted_at FROM tombstones WHERE nostr_event_id = $1
+    `, eventId); err == nil {
+		// only the author can delete, other relays may still have the event
+		if evt == nil || evt.PubKey == tombstone.Pubkey {
+			w.Header().Set("Content-Type", "application/activity+json")
+			w.WriteHeader(410)
+			json.NewEncoder(w).Encode(Tombstone{
+				Base: litepub.Base{
+					Type: "Tombstone",
+					Id:   s.ServiceURL + "/pub/note/" + eventId,
+				},
+				FormerType: "Note",
+				Deleted:    &tombstone.DeletedAt,
+			})
+			return
+		}
+	}
 
-	events := querySync(nostr.Filter{IDs: []string{eventId}}, 1)
-	if len(events) == 0 {
+	if evt == nil {
 		http.Error(w, "couldn't find note", 404)
 		return
 	}
-	note := pubNoteFromNostrEvent(events[0])
+
+	w.Header().Set("Vary", "Accept")
+	if wantsHTML(r) {
+		renderNotePage(w, *evt)
+		return
+	}
+
+	note := pubNoteFromNostrEvent(*evt)
 
 	w.Header().Set("Content-Type", "application/activity+json")
 	json.NewEncoder(w).Encode(note)
@@ -203,23 +488,83 @@ func pubInbox(w http.ResponseWriter, r *http.Request) {
 	typ := j.Get("type").String()
 	actor := j.Get("actor").String()
 
-	_, pubkey := nostrKeysForPubActor(actor)
+	owner, err := verifyRequest(r, b)
+	if err != nil {
+		// the key of a deleted actor is gone with it, but we can check that
+		if typ == "Delete" && objectId(j.Get("object")) == actor && actorIsGone(actor) {
+			owner = actor
+		} else {
+			log.Debug().Err(err).Str("actor", actor).Str("type", typ).
+				Msg("rejecting unsigned or badly signed pub event")
+			http.Error(w, "invalid signature: "+err.Error(), 401)
+			return
+		}
+	}
+	if owner != actor {
+		log.Debug().Str("owner", owner).Str("actor", actor).Str("type", typ).
+			Msg("rejecting pub event signed by someone else")
+		http.Error(w, "signature key doesn't belong to "+actor, 401)
+		return
+	}
 
 	switch typ {
-	case "Note":
-		content := j.Get("content")
-		// TODO: save a nostr event here
-		log.Print(content)
+	case "Create":
+		object := j.Get("object")
+
+		note, err := noteFromObject(object)
+		if err != nil {
+			log.Warn().Err(err).Str("object", object.Raw).Msg("invalid object on Create")
+			http.Error(w, "invalid Create object", 400)
+			return
+		}
+
+		if !note.isNote() {
+			log.Info().Str("type", note.Type).Str("body", string(b)).
+				Msg("got Create for unsupported object")
+			break
+		}
+		if note.Name != "" && note.Content == "" {
+			// a vote, we don't have polls of our own
+			log.Debug().Str("actor", actor).Str("name", note.Name).Msg("ignoring vote")
+			break
+		}
+		if note.AttributedTo != actor {
+			log.Warn().Str("actor", actor).Str("attributedTo", note.AttributedTo).
+				Msg("got Create for a note from someone else")
+			http.Error(w, "can't Create notes for someone else", 403)
+			return
+		}
+
+		evt := nostrEventFromPubNote(note)
+		publishBridgedEvent(evt)
+		if poll, ok := nostrPollEventFromPub(note, evt); ok {
+			publishBridgedEvent(poll)
+		}
 	case "Follow":
+		_, pubkey := nostrKeysForPubActor(actor)
 		object := j.Get("object").String()
-		parts := strings.Split(object, "/")
-		target := parts[len(parts)-1]
+		target, _, ok := decodePubkey(strings.TrimPrefix(object, s.ServiceURL+"/pub/user/"))
+		if !ok || !strings.HasPrefix(object, s.ServiceURL+"/pub/user/") {
+			log.Debug().Str("actor", actor).Str("object", object).Msg("got Follow for someone not here")
+			http.Error(w, "can only Follow our actors", 400)
+			return
+		}
 
-		_, err := pg.Exec(`
-            INSERT INTO followers (nostr_pubkey, pub_actor_url)
-            VALUES ($1, $2)
-            ON CONFLICT (nostr_pubkey, pub_actor_url) DO NOTHING
-        `, target, actor)
+		inbox, sharedInbox, err := actorInboxes(actor)
+		if err != nil {
+			log.Warn().Err(err).Str("actor", actor).
+				Msg("didn't found an inbox from the follower")
+			http.Error(w, "wrong Follow request", 400)
+			return
+		}
+
+		// their inboxes are kept here so we don't have to fetch them on every delivery
+		_, err = pg.Exec(`
+            INSERT INTO followers (nostr_pubkey, pub_actor_url, inbox, shared_inbox)
+            VALUES ($1, $2, $3, $4)
+            ON CONFLICT (nostr_pubkey, pub_actor_url)
+              DO UPDATE SET inbox = EXCLUDED.inbox, shared_inbox = EXCLUDED.shared_inbox
+        `, target, actor, inbox, sharedInbox)
 
 		if err != nil && err != sql.ErrNoRows {
 			log.Warn().Err(err).Str("actor", actor).Str("object", object).
@@ -228,44 +573,142 @@ func pubInbox(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		actor, err := litepub.FetchActor(actor)
-		if err != nil || actor.Inbox == "" {
-			log.Warn().Err(err).Str("actor", actor.Id).
-				Msg("didn't found an inbox from the follower")
-			http.Error(w, "wrong Follow request", 400)
-			return
-		}
-
-		accept := litepub.Accept{
+		accept := Activity{
 			Base: litepub.Base{
 				Type: "Accept",
-				Id:   s.ServiceURL + "/pub/accept/" + pubkey,
+				Id:   s.ServiceURL + "/pub/accept/" + target + "/" + pubkey,
 			},
-			Object: object,
+			Actor:  s.ServiceURL + "/pub/user/" + target,
+			Object: json.RawMessage(b),
 		}
-		resp, err := litepub.SendSigned(
-			s.PrivateKey,
-			s.ServiceURL+"/pub/user/"+pubkey+"#main-key",
-			actor.Inbox,
-			accept,
+
+		// they're obviously alive, so it's ok to talk to them again
+		reviveInbox(inbox, sharedInbox)
+		enqueueDelivery(target, inbox, accept)
+
+		break
+	case "Like":
+		evt, err := nostrEventFromPubLike(
+			actor,
+			j.Get("id").String(),
+			objectId(j.Get("object")),
+			j.Get("published").Time(),
 		)
+		if err != nil {
+			log.Debug().Err(err).Str("actor", actor).Msg("ignoring Like")
+			break
+		}
+		publishBridgedEvent(evt)
+	case "Announce":
+		// we don't trust embedded objects here, they must come from their source
+		objectUrl := objectId(j.Get("object"))
+
+		var reposted *nostr.Event
+		if id, ok := nostrEventIdForPubObject(objectUrl); ok {
+			reposted = findEvent(id)
+		}
+		if reposted == nil {
+			note, err := fetchNote(objectUrl)
+			if err != nil || !note.isNote() {
+				log.Debug().Err(err).Str("object", objectUrl).Msg("ignoring Announce")
+				break
+			}
 
-		var b []byte
-		if resp != nil && resp.Body != nil {
-			b, _ = ioutil.ReadAll(resp.Body)
-			b, _ = ioutil.ReadAll(resp.Body)
+			evt := nostrEventFromPubNote(note)
+			publishBridgedEvent(evt)
+			if poll, ok := nostrPollEventFromPub(note, evt); ok {
+				publishBridgedEvent(poll)
+			}
+			reposted = &evt
 		}
-		if err != nil {
-			log.Warn().Err(err).Str("body", string(b)).
-				Msg("failed to send Accept")
-			http.Error(w, "failed to send Accept", 503)
+
+		evt := nostrEventFromPubAnnounce(actor, j.Get("id").String(), *reposted, j.Get("published").Time())
+		publishBridgedEvent(evt)
+	case "Accept", "Reject":
+		// answers to the Follows we've sent on behalf of nostr pubkeys
+		object := j.Get("object")
+		follower := strings.TrimPrefix(object.Get("actor").String(), s.ServiceURL+"/pub/user/")
+
+		status := "accepted"
+		if typ == "Reject" {
+			status = "rejected"
+		}
+
+		if _, err := pg.Exec(`
+            UPDATE following SET status = $1
+            WHERE pub_actor_url = $2 AND (follow_id = $3 OR nostr_pubkey = $4)
+        `, status, actor, objectId(object), follower); err != nil {
+			log.Warn().Err(err).Str("actor", actor).Str("type", typ).
+				Msg("error saving Follow answer")
+			http.Error(w, "failed to accept "+typ, 500)
 			return
 		}
-		log.Print(string(b))
+	case "Update":
+		object := j.Get("object")
+		switch object.Get("type").String() {
+		case "Person", "Service", "Application", "Group", "Organization":
+			if object.Get("id").String() != actor {
+				log.Warn().Str("actor", actor).Str("object", object.Get("id").String()).
+					Msg("got Update for someone else")
+				http.Error(w, "can't Update someone else", 403)
+				return
+			}
 
-		break
+			var updated litepub.Actor
+			if err := json.Unmarshal([]byte(object.Raw), &updated); err != nil {
+				log.Warn().Err(err).Str("object", object.Raw).Msg("invalid object on Update")
+				http.Error(w, "invalid Update object", 400)
+				return
+			}
+
+			evt := nostrEventFromActorMetadata(&updated, time.Now())
+			publishBridgedEvent(evt)
+		case "Question":
+			note, err := noteFromObject(object)
+			if err != nil {
+				log.Warn().Err(err).Str("object", object.Raw).Msg("invalid object on Update")
+				http.Error(w, "invalid Update object", 400)
+				return
+			}
+			if note.AttributedTo != actor {
+				log.Warn().Str("actor", actor).Str("attributedTo", note.AttributedTo).
+					Msg("got Update for a poll from someone else")
+				http.Error(w, "can't Update someone else's poll", 403)
+				return
+			}
+
+			// we only care about the final results
+			if _, closed := note.closedAt(); !closed {
+				break
+			}
+
+			evt, err := nostrPollResultsFromPub(note)
+			if err != nil {
+				log.Warn().Err(err).Str("object", note.Id).Msg("failed to bridge poll results")
+				break
+			}
+			publishBridgedEvent(evt)
+		default:
+			log.Info().Str("type", object.Get("type").String()).
+				Msg("got Update for unsupported object")
+		}
 	case "Undo":
-		switch j.Get("object.type").String() {
+		undone := j.Get("object")
+		if undone.IsObject() && undone.Get("actor").String() != actor {
+			log.Warn().Str("actor", actor).Str("object", undone.Raw).
+				Msg("got Undo for something from someone else")
+			http.Error(w, "can't Undo things from someone else", 403)
+			return
+		}
+
+		switch undone.Get("type").String() {
+		case "Like", "Announce":
+			evt, err := nostrDeletionFromPub(actor, objectId(undone))
+			if err != nil {
+				log.Debug().Err(err).Str("actor", actor).Msg("ignoring Undo")
+				break
+			}
+			publishBridgedEvent(evt)
 		case "Follow":
 			actor := j.Get("object.actor").String()
 			object := j.Get("object.object").String()
@@ -286,22 +729,44 @@ func pubInbox(w http.ResponseWriter, r *http.Request) {
 			break
 		}
 	case "Delete":
-		actor := j.Get("actor").String()
-
-		_, err := pg.Exec(`
-            DELETE FROM pub_followers
-            WHERE follower = $1
-        `, actor)
+		objectUrl := objectId(j.Get("object"))
+
+		if objectUrl == actor {
+			// the actor is gone, so forget about them
+			for _, query := range []string{
+				"DELETE FROM followers WHERE pub_actor_url = $1",
+				"DELETE FROM keys WHERE pub_actor_url = $1",
+			} {
+				if _, err := pg.Exec(query, actor); err != nil {
+					log.Warn().Err(err).Str("actor", actor).Msg("error accepting Delete")
+					http.Error(w, "failed to accept Delete", 500)
+					return
+				}
+			}
+			break
+		}
 
-		if err != nil && err != sql.ErrNoRows {
-			log.Warn().Err(err).Str("actor", actor).Msg("error accepting Delete")
-			http.Error(w, "failed to accept Delete", 500)
-			return
+		evt, err := nostrDeletionFromPub(actor, objectUrl)
+		if err != nil {
+			log.Debug().Err(err).Str("actor", actor).Msg("ignoring Delete")
+			break
+		}
+		publishBridgedEvent(evt)
+		for _, tag := range evt.Tags.GetAll([]string{"e", ""}) {
+			uncacheEvent(tag.Value(), evt.PubKey)
 		}
-		break
 	default:
 		log.Info().Str("type", typ).Str("body", string(b)).Msg("got unexpected pub event")
 	}
 
 	w.WriteHeader(200)
 }
+
+// objectId gets the id of the "object" of an activity, which can be embedded or
+// just be an url.
+func objectId(object gjson.Result) string {
+	if object.IsObject() {
+		return object.Get("id").String()
+	}
+	return object.String()
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestPageOfEvents(t *testing.T) {
+	// many events in the same second, so pages end in the middle of seconds
+	all := make([]nostr.Event, 0, 130)
+	for i := 0; i < 130; i++ {
+		all = append(all, nostr.Event{
+			ID:        fmt.Sprintf("%064x", (i*7919)%1000),
+			CreatedAt: time.Unix(int64(1700000000+i/7), 0),
+		})
+	}
+	expected := append([]nostr.Event{}, all...)
+	newestFirst(expected)
+
+	// going back in time with the next links
+	var pages [][]nostr.Event
+	var before *pageCursor
+	for {
+		page := pageOfEvents(all, nil, before)
+		if len(page) == 0 {
+			break
+		}
+		pages = append(pages, page)
+		before = cursorFor(page[len(page)-1])
+	}
+
+	var walked []nostr.Event
+	for _, page := range pages {
+		walked = append(walked, page...)
+	}
+	if len(walked) != len(expected) {
+		t.Fatalf("expected %d events going back, got %d", len(expected), len(walked))
+	}
+	for i := range walked {
+		if walked[i].ID != expected[i].ID {
+			t.Fatalf("event %d going back is %s, expected %s", i, walked[i].ID, expected[i].ID)
+		}
+	}
+
+	// and forward again with the prev links, which must give the same pages
+	for i := len(pages) - 1; i > 0; i-- {
+		prev := pageOfEvents(all, cursorFor(pages[i][0]), nil)
+		if len(prev) != len(pages[i-1]) {
+			t.Fatalf("prev of page %d has %d events, expected %d", i, len(prev), len(pages[i-1]))
+		}
+		for j := range prev {
+			if prev[j].ID != pages[i-1][j].ID {
+				t.Fatalf("prev of page %d differs at %d", i, j)
+			}
+		}
+	}
+}
+
+func TestParsePageCursor(t *testing.T) {
+	cursor := parsePageCursor("1700000000-abcd")
+	if cursor == nil || cursor.time.Unix() != 1700000000 || cursor.id != "abcd" {
+		t.Fatalf("unexpected cursor %v", cursor)
+	}
+	if parsed := parsePageCursor(cursor.String()); *parsed != *cursor {
+		t.Fatalf("cursor changed after a round trip: %v", parsed)
+	}
+
+	// the cursors from before ids were added still work
+	if cursor := parsePageCursor("1700000000"); cursor == nil || cursor.id != "" {
+		t.Fatalf("unexpected cursor %v", cursor)
+	}
+	if cursor := parsePageCursor("nope"); cursor != nil {
+		t.Fatalf("expected no cursor, got %v", cursor)
+	}
+}
+
+func TestHandleFromActorURL(t *testing.T) {
+	for url, want := range map[string]string{
+		"https://mastodon.example.com/users/alice": "alice@mastodon.example.com",
+		"https://pleroma.example.com/users/bob/":   "bob@pleroma.example.com",
+		"https://misskey.example.com/@carol":       "carol@misskey.example.com",
+		"https://example.com:8443/users/dave":      "dave@example.com",
+	} {
+		if got := handleFromActorURL(url); got != want {
+			t.Errorf("%s: expected %q, got %q", url, want, got)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+type delivery struct {
+	ActivityId  string `db:"activity_id"`
+	Inbox       string `db:"inbox"`
+	NostrPubkey string `db:"nostr_pubkey"`
+	Activity    string `db:"activity"`
+	Attempts    int    `db:"attempts"`
+}
+
+// enqueueDelivery schedules an activity signed by the bridged actor of the given
+// nostr pubkey to be sent to a pub inbox. an activity is only queued once for each
+// inbox while it is waiting to be sent.
+func enqueueDelivery(pubkey string, inbox string, activity any) {
+	var dead bool
+	pg.Get(&dead, "SELECT dead FROM inboxes WHERE url = $1", inbox)
+	if dead {
+		log.Debug().Str("inbox", inbox).Msg("not delivering to dead inbox")
+		return
+	}
+
+	j, activityId := encodeActivity(activity)
+
+	if _, err := pg.Exec(`
+        INSERT INTO deliveries (activity_id, inbox, nostr_pubkey, activity)
+        VALUES ($1, $2, $3, $4)
+        ON CONFLICT (activity_id, inbox) DO NOTHING
+    `, activityId, inbox, pubkey, string(j)); err != nil {
+		log.Warn().Err(err).Str("inbox", inbox).Str("activity", activityId).
+			Msg("failed to enqueue delivery")
+	}
+}
+
+// encodeActivity returns the JSON of an activity and its id, which is what makes
+// deliveries of the same activity to the same inbox the same delivery.
+func encodeActivity(activity any) ([]byte, string) {
+	j, _ := json.Marshal(activity)
+	return j, gjson.GetBytes(j, "id").String()
+}
+
+// reviveInbox makes inboxes we had given up on eligible for deliveries again.
+func reviveInbox(inboxes ...string) {
+	for _, inbox := range inboxes {
+		if inbox != "" {
+			pg.Exec("UPDATE inboxes SET dead = false, failures = 0 WHERE url = $1", inbox)
+		}
+	}
+}
+
+// processDeliveries runs forever sending the pending deliveries.
+func processDeliveries() {
+	for {
+		if deliverPending() == 0 {
+			time.Sleep(5 * time.Second)
+		}
+	}
+}
+
+func deliverPending() int {
+	// take the due deliveries and push them a little forward so no one else
+	// takes them while we are working on them
+	var jobs []delivery
+	if err := pg.Select(&jobs, `
+        UPDATE deliveries SET next_attempt = now() + interval '5 minutes'
+        WHERE (activity_id, inbox) IN (
+          SELECT activity_id, inbox FROM deliveries
+          WHERE next_attempt <= now()
+          ORDER BY next_attempt
+          LIMIT 20
+          FOR UPDATE SKIP LOCKED
+        )
+        RETURNING activity_id, inbox, nostr_pubkey, activity, attempts
+    `); err != nil {
+		log.Warn().Err(err).Msg("failed to load pending deliveries")
+		return 0
+	}
+
+	var wg sync.WaitGroup
+	for _, job := range jobs {
+		wg.Add(1)
+		go func(job delivery) {
+			defer wg.Done()
+
+			if err := deliver(job); err != nil {
+				retryDelivery(job, err)
+				return
+			}
+
+			pg.Exec("DELETE FROM deliveries WHERE activity_id = $1 AND inbox = $2",
+				job.ActivityId, job.Inbox)
+			pg.Exec("UPDATE inboxes SET failures = 0 WHERE url = $1", job.Inbox)
+		}(job)
+	}
+	wg.Wait()
+
+	return len(jobs)
+}
+
+func deliver(job delivery) error {
+	sk, err := actorKey(job.NostrPubkey)
+	if err != nil {
+		return fmt.Errorf("failed to get key for %s: %w", job.NostrPubkey, err)
+	}
+
+	return deliverSigned(sk, s.ServiceURL+"/pub/user/"+job.NostrPubkey+"#main-key",
+		job.Inbox, []byte(job.Activity))
+}
+
+func deliverSigned(sk *rsa.PrivateKey, keyId string, inbox string, activity []byte) error {
+	resp, err := postSigned(sk, keyId, inbox, activity)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	b, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode >= 300 {
+		if len(b) > 200 {
+			b = b[:200]
+		}
+		return fmt.Errorf("got status %d: %s", resp.StatusCode, string(b))
+	}
+	return nil
+}
+
+// retryBackoff says how long to wait before trying a delivery again after it failed
+// for the given number of times, or that it should be given up on.
+func retryBackoff(attempts int) (time.Duration, bool) {
+	if attempts >= s.DeliveryMaxAttempts {
+		return 0, false
+	}
+
+	// exponential backoff, from 30 seconds up to 12 hours
+	backoff := 30 * time.Second << (attempts - 1)
+	if backoff > 12*time.Hour || backoff <= 0 {
+		backoff = 12 * time.Hour
+	}
+	return backoff, true
+}
+
+// inboxIsDead tells if we should stop delivering to an inbox after giving up on
+// this many deliveries to it in a row.
+func inboxIsDead(failures int) bool {
+	return failures >= s.DeadInboxFailures
+}
+
+func retryDelivery(job delivery, cause error) {
+	attempts := job.Attempts + 1
+	logger := log.With().Err(cause).Str("inbox", job.Inbox).Str("activity", job.ActivityId).
+		Int("attempts", attempts).Logger()
+
+	if backoff, retry := retryBackoff(attempts); retry {
+		logger.Debug().Dur("backoff", backoff).Msg("delivery failed, will retry")
+		pg.Exec(`
+            UPDATE deliveries
+            SET attempts = $3, last_error = $4, next_attempt = now() + make_interval(secs => $5)
+            WHERE activity_id = $1 AND inbox = $2
+        `, job.ActivityId, job.Inbox, attempts, cause.Error(), backoff.Seconds())
+		return
+	}
+
+	// give up on this delivery and maybe on the inbox entirely
+	logger.Warn().Msg("giving up on delivery")
+	pg.Exec("DELETE FROM deliveries WHERE activity_id = $1 AND inbox = $2",
+		job.ActivityId, job.Inbox)
+
+	var failures int
+	if err := pg.Get(&failures, `
+        INSERT INTO inboxes (url, failures) VALUES ($1, 1)
+        ON CONFLICT (url) DO UPDATE SET failures = inboxes.failures + 1
+        RETURNING failures
+    `, job.Inbox); err != nil {
+		log.Warn().Err(err).Str("inbox", job.Inbox).Msg("failed to count inbox failure")
+		return
+	}
+
+	if inboxIsDead(failures) {
+		log.Warn().Str("inbox", job.Inbox).Int("failures", failures).Msg("marking inbox as dead")
+		pg.Exec("UPDATE inboxes SET dead = true WHERE url = $1", job.Inbox)
+		pg.Exec("DELETE FROM deliveries WHERE inbox = $1", job.Inbox)
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fiatjaf/litepub"
+)
+
+func TestDeliverSigned(t *testing.T) {
+	as := newActorServer(t)
+	key := newTestKey(t)
+	actor := as.URL + "/pub/user/alice"
+	as.addActor("/pub/user/alice", actor+"#main-key", actor, key)
+
+	// an inbox that checks signatures the way mastodon does
+	var verified string
+	inbox := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		owner, err := verifyRequest(r, body)
+		if err != nil {
+			http.Error(w, err.Error(), 401)
+			return
+		}
+		verified = owner
+		w.WriteHeader(202)
+	}))
+	defer inbox.Close()
+
+	// and one that fails on purpose
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "something went wrong", 500)
+	}))
+	defer broken.Close()
+
+	// and one that isn't there anymore
+	gone := httptest.NewServer(http.NotFoundHandler())
+	gone.Close()
+
+	activity := []byte(`{"id":"https://bridge.example.com/pub/follow/1","type":"Follow"}`)
+
+	tests := []struct {
+		name  string
+		inbox string
+		keyId string
+		err   string
+	}{
+		{name: "accepted", inbox: inbox.URL + "/inbox", keyId: actor + "#main-key"},
+		{name: "wrong key", inbox: inbox.URL + "/inbox", keyId: as.URL + "/pub/user/bob#main-key", err: "status 401"},
+		{name: "server error", inbox: broken.URL + "/inbox", keyId: actor + "#main-key", err: "status 500"},
+		{name: "unreachable", inbox: gone.URL + "/inbox", keyId: actor + "#main-key", err: "connect"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			verified = ""
+			err := deliverSigned(key, test.keyId, test.inbox, activity)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if verified != actor {
+				t.Fatalf("expected the inbox to see %q, got %q", actor, verified)
+			}
+		})
+	}
+}
+
+func TestSignRequestHeaders(t *testing.T) {
+	r := httptest.NewRequest("POST", "https://mastodon.example.com/inbox", strings.NewReader("{}"))
+	if err := signRequest(r, newTestKey(t), "https://bridge.example.com/pub/user/a#main-key", []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+
+	if digest := r.Header.Get("Digest"); digest != "SHA-256=RBNvo1WzZ4oRRq0W9+hknpT7T8If536DEMBg9hyq/4o=" {
+		t.Fatalf("unexpected digest %q", digest)
+	}
+	if !strings.Contains(r.Header.Get("Signature"), `headers="(request-target) host date digest"`) {
+		t.Fatalf("signature doesn't cover the digest: %q", r.Header.Get("Signature"))
+	}
+	if !strings.HasSuffix(r.Header.Get("Date"), " GMT") {
+		t.Fatalf("unexpected date %q", r.Header.Get("Date"))
+	}
+}
+
+func TestRetryAgainstFailingInbox(t *testing.T) {
+	defer func(previous Settings) { s = previous }(s)
+	s.DeliveryMaxAttempts = 10
+	s.DeadInboxFailures = 3
+
+	var received int
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received++
+		http.Error(w, "try again later", 503)
+	}))
+	defer broken.Close()
+
+	key := newTestKey(t)
+	activity := []byte(`{"id":"https://bridge.example.com/pub/create/1","type":"Create"}`)
+
+	// what the queue does with one delivery until it gives up
+	tests := []struct {
+		attempts int
+		backoff  time.Duration
+		retry    bool
+	}{
+		{1, 30 * time.Second, true},
+		{2, time.Minute, true},
+		{3, 2 * time.Minute, true},
+		{5, 8 * time.Minute, true},
+		{8, 64 * time.Minute, true},
+		{9, 128 * time.Minute, true},
+		{10, 0, false},
+	}
+	for _, test := range tests {
+		if err := deliverSigned(key, "https://bridge.example.com/pub/user/a#main-key",
+			broken.URL+"/inbox", activity); err == nil {
+			t.Fatalf("attempt %d: expected the delivery to fail", test.attempts)
+		}
+
+		backoff, retry := retryBackoff(test.attempts)
+		if backoff != test.backoff || retry != test.retry {
+			t.Fatalf("attempt %d: expected (%s, %v), got (%s, %v)",
+				test.attempts, test.backoff, test.retry, backoff, retry)
+		}
+	}
+	if received != len(tests) {
+		t.Fatalf("expected the inbox to get %d requests, got %d", len(tests), received)
+	}
+
+	// the backoff stops growing at 12 hours
+	s.DeliveryMaxAttempts = 100
+	for _, attempts := range []int{12, 20, 40, 70, 99} {
+		if backoff, retry := retryBackoff(attempts); backoff != 12*time.Hour || !retry {
+			t.Fatalf("attempt %d: expected 12h, got (%s, %v)", attempts, backoff, retry)
+		}
+	}
+
+	for failures, dead := range []bool{false, false, false, true, true} {
+		if inboxIsDead(failures) != dead {
+			t.Fatalf("%d failures: expected dead to be %v", failures, dead)
+		}
+	}
+}
+
+func TestEncodeActivity(t *testing.T) {
+	// deliveries are deduplicated on the activity id
+	_, id := encodeActivity(Activity{Base: litepub.Base{Type: "Like", Id: "https://bridge.example.com/pub/like/1"}})
+	if id != "https://bridge.example.com/pub/like/1" {
+		t.Fatalf("unexpected id %q", id)
+	}
+	_, again := encodeActivity(json.RawMessage(`{"type":"Like","id":"https://bridge.example.com/pub/like/1"}`))
+	if again != id {
+		t.Fatalf("the same activity got different ids %q and %q", id, again)
+	}
+}
@@ -2,9 +2,12 @@ package main
 
 import (
 	"encoding/json"
+	"sort"
+	"time"
 
 	"github.com/fiatjaf/litepub"
 	"github.com/fiatjaf/relayer"
+	"github.com/lib/pq"
 	"github.com/nbd-wtf/go-nostr"
 	"golang.org/x/exp/slices"
 )
@@ -13,6 +16,9 @@ type Relay struct {
 	storage Storage
 }
 
+// events bridged from activitypub that must be pushed to our subscribers
+var bridgedEvents = make(chan nostr.Event, 100)
+
 func (r Relay) Name() string {
 	return "no-fed"
 }
@@ -23,6 +29,10 @@ func (r Relay) Storage() relayer.Storage {
 
 func (r Relay) OnInitialized() {}
 
+func (r Relay) InjectEvents() chan nostr.Event {
+	return bridgedEvents
+}
+
 func (relay Relay) Init() error {
 	filters := relayer.GetListeningFilters()
 	for _, filter := range filters {
@@ -33,15 +43,39 @@ func (relay Relay) Init() error {
 }
 
 func (r Relay) AcceptEvent(evt *nostr.Event) bool {
-	// block events that are too large
+	// block events that are too large, but contact lists are big and we need
+	// them to bridge follows
+	limit := 10000
+	if evt.Kind == 3 {
+		limit = 500000
+	}
+
 	jsonb, _ := json.Marshal(evt)
-	if len(jsonb) > 10000 {
+	if len(jsonb) > limit {
 		return false
 	}
 
 	return true
 }
 
+// publishBridgedEvent stores an event generated from an activitypub object
+// and sends it to the subscribers that are listening for it.
+func publishBridgedEvent(evt nostr.Event) {
+	if _, err := saveEvent(evt); err != nil {
+		log.Warn().Err(err).Interface("evt", evt).Msg("failed to save bridged event")
+	}
+
+	if evt.Kind == 5 {
+		for _, tag := range evt.Tags.GetAll([]string{"e", ""}) {
+			if err := deleteEvent(tag.Value(), evt.PubKey); err != nil {
+				log.Warn().Err(err).Str("id", tag.Value()).Msg("failed to delete bridged event")
+			}
+		}
+	}
+
+	bridgedEvents <- evt
+}
+
 type Storage struct{}
 
 func (s Storage) Init() error {
@@ -49,77 +83,227 @@ func (s Storage) Init() error {
 }
 
 func (s Storage) SaveEvent(evt *nostr.Event) error {
-	// we don't store anything
-	return nil
+	isNew, err := saveEvent(*evt)
+	if isNew {
+		go federateEvent(*evt)
+	}
+	return err
 }
 
-func (s Storage) QueryEvents(filter *nostr.Filter) (events []nostr.Event, err error) {
-	// search activitypub servers for these specific notes
-	if len(filter.IDs) > 0 {
-		for _, id := range filter.IDs {
-			var noteUrl string
-			if err := pg.Get(&noteUrl, "SELECT pub_note_url FROM notes WHERE nostr_event_id = $1", id); err != nil {
-				continue
-			}
+func (s Storage) QueryEvents(filter *nostr.Filter) ([]nostr.Event, error) {
+	events, err := queryEvents(*filter)
+	if err != nil {
+		log.Warn().Err(err).Stringer("filter", filter).Msg("failed to query stored events")
+	}
+	if len(events) > 0 {
+		// what we have may be old, so the pub servers are asked again from time to time
+		if claimRefresh(*filter) {
+			go refreshFromPub(*filter)
+		}
+		return events, nil
+	}
 
-			note, err := litepub.FetchNote(noteUrl)
-			if err != nil {
-				continue
-			}
-			evt := nostrEventFromPubNote(note)
-			events = append(events, evt)
+	// we don't have anything, so try the activitypub servers
+	claimRefresh(*filter)
+	events, err = queryPubEvents(filter)
+	for _, evt := range events {
+		if _, err := saveEvent(evt); err != nil {
+			log.Warn().Err(err).Interface("evt", evt).Msg("failed to save bridged event")
 		}
+	}
+	return events, err
+}
 
-		return events, nil
+const pubRefreshInterval = 6 * time.Hour
+
+// claimRefresh tells if the pub servers should be asked about what a filter wants
+// because they weren't in the last pubRefreshInterval, and notes that they were.
+func claimRefresh(filter nostr.Filter) bool {
+	keys := make(pq.StringArray, 0, len(filter.IDs)+len(filter.Authors))
+	for _, id := range filter.IDs {
+		keys = append(keys, "id:"+id)
+	}
+	for _, pubkey := range filter.Authors {
+		keys = append(keys, "author:"+pubkey)
+	}
+	for _, id := range filter.Tags["e"] {
+		keys = append(keys, "replies:"+id)
+	}
+	if len(keys) == 0 {
+		return false
+	}
+
+	var claimed []string
+	if err := pg.Select(&claimed, `
+        INSERT INTO refreshes (key, refreshed_at)
+        SELECT unnest($1::text[]), now()
+        ON CONFLICT (key) DO UPDATE SET refreshed_at = now()
+          WHERE refreshes.refreshed_at < now() - make_interval(secs => $2)
+        RETURNING key
+    `, keys, pubRefreshInterval.Seconds()); err != nil {
+		log.Warn().Err(err).Msg("failed to claim refresh")
+		return false
+	}
+	return len(claimed) > 0
+}
+
+// refreshFromPub gets what a filter wants from the pub servers again and sends
+// whatever is new to the subscribers.
+func refreshFromPub(filter nostr.Filter) {
+	events, err := queryPubEvents(&filter)
+	if err != nil {
+		log.Debug().Err(err).Stringer("filter", &filter).Msg("failed to refresh from pub")
+	}
+	for _, evt := range events {
+		isNew, err := saveEvent(evt)
+		if err != nil {
+			log.Warn().Err(err).Interface("evt", evt).Msg("failed to save bridged event")
+		}
+		if isNew {
+			bridgedEvents <- evt
+		}
+	}
+}
+
+// pubFetcher is how queryPubEvents finds things on pub servers and turns them into
+// nostr events, it is an interface so tests can use a fake.
+type pubFetcher interface {
+	noteURL(id string) (string, bool)
+	actorURL(pubkey string) (string, bool)
+
+	fetchActor(url string) (*litepub.Actor, error)
+	fetchNote(url string) (*Note, error)
+	fetchNotes(outboxUrl string) ([]Note, error)
+	fetchReplies(noteUrl string) []Note
+
+	noteEvent(note *Note) nostr.Event
+	metadataEvent(actor *litepub.Actor) nostr.Event
+	followsEvent(actor *litepub.Actor) nostr.Event
+}
+
+var fetcher pubFetcher = livePubFetcher{}
+
+type livePubFetcher struct{}
+
+func (livePubFetcher) noteURL(id string) (string, bool) {
+	var noteUrl string
+	err := pg.Get(&noteUrl, "SELECT pub_note_url FROM notes WHERE nostr_event_id = $1", id)
+	return noteUrl, err == nil
+}
+
+func (livePubFetcher) actorURL(pubkey string) (string, bool) {
+	var actorUrl string
+	err := pg.Get(&actorUrl, "SELECT pub_actor_url FROM keys WHERE nostr_pubkey = $1", pubkey)
+	return actorUrl, err == nil
+}
+
+func (livePubFetcher) fetchActor(url string) (*litepub.Actor, error) { return litepub.FetchActor(url) }
+func (livePubFetcher) fetchNote(url string) (*Note, error)           { return fetchNote(url) }
+func (livePubFetcher) fetchNotes(outboxUrl string) ([]Note, error)   { return fetchNotes(outboxUrl) }
+func (livePubFetcher) fetchReplies(noteUrl string) []Note            { return fetchReplies(noteUrl) }
+
+func (livePubFetcher) noteEvent(note *Note) nostr.Event { return nostrEventFromPubNote(note) }
+func (livePubFetcher) metadataEvent(actor *litepub.Actor) nostr.Event {
+	return nostrEventFromActorMetadata(actor, actor.Published)
+}
+func (livePubFetcher) followsEvent(actor *litepub.Actor) nostr.Event {
+	return nostrEventFromActorFollows(actor)
+}
+
+func queryPubEvents(filter *nostr.Filter) ([]nostr.Event, error) {
+	events := make([]nostr.Event, 0, 20)
+	wantsKind := func(kind int) bool {
+		return filter.Kinds == nil || slices.Contains(filter.Kinds, kind)
+	}
+
+	// search activitypub servers for these specific notes
+	for _, id := range filter.IDs {
+		noteUrl, ok := fetcher.noteURL(id)
+		if !ok {
+			continue
+		}
+
+		note, err := fetcher.fetchNote(noteUrl)
+		if err != nil {
+			continue
+		}
+		events = append(events, fetcher.noteEvent(note))
 	}
 
 	// search activitypub servers for stuff from these authors
 	for _, pubkey := range filter.Authors {
-		var actorUrl string
-		if err := pg.Get(&actorUrl, "SELECT pub_actor_url FROM keys WHERE pubkey = $1", pubkey); err != nil {
+		actorUrl, ok := fetcher.actorURL(pubkey)
+		if !ok {
 			continue
 		}
 
-		actor, err := litepub.FetchActor(actorUrl)
+		actor, err := fetcher.fetchActor(actorUrl)
 		if err != nil {
 			continue
 		}
 
-		if slices.Contains(filter.Kinds, 0) {
+		if wantsKind(0) {
 			// return actor metadata
-			events = append(events, nostrEventFromActorMetadata(actor))
+			events = append(events, fetcher.metadataEvent(actor))
 		}
 
-		if slices.Contains(filter.Kinds, 1) {
-			// return actor notes
-			notes, err := litepub.FetchNotes(actor.Outbox)
+		if wantsKind(1) || wantsKind(1068) {
+			// return actor notes and polls
+			notes, err := fetcher.fetchNotes(actor.Outbox)
 			if err == nil {
 				for _, note := range notes {
-					events = append(events, nostrEventFromPubNote(&note))
+					evt := fetcher.noteEvent(&note)
+					events = append(events, evt)
+					if poll, ok := nostrPollEventFromPub(&note, evt); ok {
+						events = append(events, poll)
+					}
 				}
 			}
 		}
 
-		if slices.Contains(filter.Kinds, 3) {
+		if wantsKind(3) {
 			// return actor follows
-			events = append(events, nostrEventFromActorFollows(actor))
+			events = append(events, fetcher.followsEvent(actor))
 		}
 	}
 
 	// search activity pub for replies to a note
-	for _, id := range filter.Tags["e"] {
-		var url string
-		if err := pg.Get(&url, "SELECT pub_note_url FROM notes WHERE nostr_event_id  = $1", id); err == nil {
-			if note, err := litepub.FetchNote(url); err == nil {
-				evt := nostrEventFromPubNote(note)
-				events = append(events, evt)
+	if wantsKind(1) {
+		for _, id := range filter.Tags["e"] {
+			url, ok := fetcher.noteURL(id)
+			if !ok {
+				continue
 			}
+
+			for _, reply := range fetcher.fetchReplies(url) {
+				events = append(events, fetcher.noteEvent(&reply))
+			}
+		}
+	}
+
+	// the same event may have been found more than once and we may have found
+	// stuff that doesn't match the rest of the filter
+	results := make([]nostr.Event, 0, len(events))
+	seen := make(map[string]bool, len(events))
+	for _, evt := range events {
+		if seen[evt.ID] || !filter.Matches(&evt) {
+			continue
 		}
+		seen[evt.ID] = true
+		results = append(results, evt)
 	}
 
-	return nil, nil
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].CreatedAt.After(results[j].CreatedAt)
+	})
+
+	if filter.Limit > 0 && len(results) > filter.Limit {
+		results = results[0:filter.Limit]
+	}
+
+	return results, nil
 }
 
 func (s Storage) DeleteEvent(id string, pubkey string) error {
-	return nil
+	return deleteAndFederate(id, pubkey)
 }
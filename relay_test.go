@@ -0,0 +1,261 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fiatjaf/litepub"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// fakePubFetcher serves actors and notes from memory instead of from pub servers.
+type fakePubFetcher struct {
+	actors  map[string]*litepub.Actor // by url
+	pubkeys map[string]string         // actor url -> nostr pubkey
+	notes   []*Note
+	ids     map[string]string // note url -> nostr event id
+}
+
+func newFakePubFetcher() *fakePubFetcher {
+	return &fakePubFetcher{
+		actors:  make(map[string]*litepub.Actor),
+		pubkeys: make(map[string]string),
+		ids:     make(map[string]string),
+	}
+}
+
+func (f *fakePubFetcher) addActor(name string, pubkey string) string {
+	url := "https://pub.example.com/users/" + name
+	actor := &litepub.Actor{Name: name, Outbox: url + "/outbox",
+		Published: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)}
+	actor.Id = url
+	f.actors[url] = actor
+	f.pubkeys[url] = pubkey
+	return url
+}
+
+// addNote stores a note whose content is label and returns its url and event id.
+func (f *fakePubFetcher) addNote(label string, author string, published time.Time, replyTo string) (string, string) {
+	note := &Note{InReplyTo: replyTo}
+	note.Id = "https://pub.example.com/notes/" + label
+	note.AttributedTo = author
+	note.Published = published
+	note.Content = label
+	f.notes = append(f.notes, note)
+	f.ids[note.Id] = f.noteEvent(note).ID
+	return note.Id, f.ids[note.Id]
+}
+
+func (f *fakePubFetcher) noteURL(id string) (string, bool) {
+	for url, noteId := range f.ids {
+		if noteId == id {
+			return url, true
+		}
+	}
+	return "", false
+}
+
+func (f *fakePubFetcher) actorURL(pubkey string) (string, bool) {
+	for url, pk := range f.pubkeys {
+		if pk == pubkey {
+			return url, true
+		}
+	}
+	return "", false
+}
+
+func (f *fakePubFetcher) fetchActor(url string) (*litepub.Actor, error) {
+	if actor, ok := f.actors[url]; ok {
+		return actor, nil
+	}
+	return nil, fmt.Errorf("actor '%s' not found", url)
+}
+
+func (f *fakePubFetcher) fetchNote(url string) (*Note, error) {
+	for _, note := range f.notes {
+		if note.Id == url {
+			return note, nil
+		}
+	}
+	return nil, fmt.Errorf("note '%s' not found", url)
+}
+
+func (f *fakePubFetcher) fetchNotes(outboxUrl string) ([]Note, error) {
+	var notes []Note
+	for _, note := range f.notes {
+		if f.actors[note.AttributedTo].Outbox == outboxUrl {
+			notes = append(notes, *note)
+		}
+	}
+	return notes, nil
+}
+
+func (f *fakePubFetcher) fetchReplies(noteUrl string) []Note {
+	var replies []Note
+	for _, note := range f.notes {
+		if note.ReplyTo() == noteUrl {
+			replies = append(replies, *note)
+		}
+	}
+	return replies
+}
+
+func (f *fakePubFetcher) noteEvent(note *Note) nostr.Event {
+	evt := nostr.Event{
+		PubKey:    f.pubkeys[note.AttributedTo],
+		CreatedAt: note.Published,
+		Kind:      1,
+		Tags:      nostr.Tags{},
+		Content:   note.Content,
+	}
+	if parent, ok := f.ids[note.ReplyTo()]; ok {
+		evt.Tags = append(evt.Tags, nostr.Tag{"e", parent})
+	}
+	evt.ID = evt.GetID()
+	return evt
+}
+
+func (f *fakePubFetcher) metadataEvent(actor *litepub.Actor) nostr.Event {
+	evt := nostr.Event{
+		PubKey:    f.pubkeys[actor.Id],
+		CreatedAt: actor.Published,
+		Kind:      0,
+		Tags:      nostr.Tags{},
+		Content:   actor.Name + "'s metadata",
+	}
+	evt.ID = evt.GetID()
+	return evt
+}
+
+func (f *fakePubFetcher) followsEvent(actor *litepub.Actor) nostr.Event {
+	evt := nostr.Event{
+		PubKey:  f.pubkeys[actor.Id],
+		Kind:    3,
+		Tags:    nostr.Tags{},
+		Content: actor.Name + "'s follows",
+	}
+	evt.ID = evt.GetID()
+	return evt
+}
+
+func TestQueryPubEvents(t *testing.T) {
+	f := newFakePubFetcher()
+	defer func(previous pubFetcher) { fetcher = previous }(fetcher)
+	fetcher = f
+
+	alicePubkey := strings.Repeat("a", 64)
+	bobPubkey := strings.Repeat("b", 64)
+	alice := f.addActor("alice", alicePubkey)
+	bob := f.addActor("bob", bobPubkey)
+
+	day := func(n int) time.Time { return time.Date(2023, 1, n, 12, 0, 0, 0, time.UTC) }
+	first, firstId := f.addNote("first", alice, day(1), "")
+	_, secondId := f.addNote("second", alice, day(2), "")
+	f.addNote("third", alice, day(3), "")
+	f.addNote("bob replies", bob, day(4), first)
+	f.addNote("alice replies", alice, day(5), first)
+
+	tests := []struct {
+		name   string
+		filter nostr.Filter
+		want   []string // contents, newest first
+	}{
+		{
+			name:   "ids",
+			filter: nostr.Filter{IDs: []string{secondId, firstId}},
+			want:   []string{"second", "first"},
+		},
+		{
+			name:   "unknown id",
+			filter: nostr.Filter{IDs: []string{strings.Repeat("0", 64)}},
+			want:   []string{},
+		},
+		{
+			name:   "author metadata",
+			filter: nostr.Filter{Kinds: []int{0}, Authors: []string{alicePubkey}},
+			want:   []string{"alice's metadata"},
+		},
+		{
+			name:   "author notes",
+			filter: nostr.Filter{Kinds: []int{1}, Authors: []string{alicePubkey}},
+			want:   []string{"alice replies", "third", "second", "first"},
+		},
+		{
+			name:   "author follows",
+			filter: nostr.Filter{Kinds: []int{3}, Authors: []string{bobPubkey}},
+			want:   []string{"bob's follows"},
+		},
+		{
+			name:   "everything from an author",
+			filter: nostr.Filter{Authors: []string{bobPubkey}},
+			want:   []string{"bob replies", "bob's metadata", "bob's follows"},
+		},
+		{
+			name:   "unknown author",
+			filter: nostr.Filter{Authors: []string{strings.Repeat("c", 64)}},
+			want:   []string{},
+		},
+		{
+			name: "since and until",
+			filter: nostr.Filter{Kinds: []int{1}, Authors: []string{alicePubkey},
+				Since: timePtr(day(2)), Until: timePtr(day(3))},
+			want: []string{"third", "second"},
+		},
+		{
+			name:   "limit keeps the newest",
+			filter: nostr.Filter{Kinds: []int{1}, Authors: []string{alicePubkey}, Limit: 2},
+			want:   []string{"alice replies", "third"},
+		},
+		{
+			name:   "replies",
+			filter: nostr.Filter{Kinds: []int{1}, Tags: nostr.TagMap{"e": {firstId}}},
+			want:   []string{"alice replies", "bob replies"},
+		},
+		{
+			name:   "replies from an author",
+			filter: nostr.Filter{Kinds: []int{1}, Authors: []string{bobPubkey}, Tags: nostr.TagMap{"e": {firstId}}},
+			want:   []string{"bob replies"},
+		},
+		{
+			name:   "found more than once",
+			filter: nostr.Filter{IDs: []string{firstId}, Kinds: []int{1}, Authors: []string{alicePubkey}},
+			want:   []string{"first"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			events, err := queryPubEvents(&test.filter)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			got := make([]string, len(events))
+			for i, evt := range events {
+				got[i] = evt.Content
+			}
+			if strings.Join(got, "|") != strings.Join(test.want, "|") {
+				t.Fatalf("expected %q, got %q", test.want, got)
+			}
+		})
+	}
+}
+
+func timePtr(t time.Time) *time.Time { return &t }
+
+func TestAcceptEvent(t *testing.T) {
+	contacts := nostr.Event{Kind: 3, Tags: nostr.Tags{}}
+	for i := 0; i < 1000; i++ {
+		contacts.Tags = append(contacts.Tags, nostr.Tag{"p", fmt.Sprintf("%064x", i), "wss://relay.example.com"})
+	}
+	big := nostr.Event{Kind: 1, Content: strings.Repeat("a", 20000)}
+
+	if !(Relay{}).AcceptEvent(&contacts) {
+		t.Fatal("refused a contact list with 1000 contacts")
+	}
+	if (Relay{}).AcceptEvent(&big) {
+		t.Fatal("accepted a huge note")
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/fiatjaf/litepub"
+)
+
+// verifyRequest checks the draft-cavage HTTP signature of an inbox POST
+// and returns the url of the actor that owns the key that signed it.
+func verifyRequest(r *http.Request, body []byte) (string, error) {
+	params := make(map[string]string)
+	for _, entry := range strings.Split(r.Header.Get("Signature"), ",") {
+		kv := strings.SplitN(strings.TrimSpace(entry), "=", 2)
+		if len(kv) == 2 {
+			params[kv[0]] = strings.Trim(kv[1], `"`)
+		}
+	}
+
+	keyId := params["keyId"]
+	if keyId == "" || params["signature"] == "" {
+		return "", fmt.Errorf("missing or malformed Signature header")
+	}
+
+	switch params["algorithm"] {
+	case "", "rsa-sha256", "hs2019":
+	default:
+		return "", fmt.Errorf("unsupported signature algorithm '%s'", params["algorithm"])
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(params["signature"])
+	if err != nil {
+		return "", fmt.Errorf("signature is invalid base64: %w", err)
+	}
+
+	headers := strings.Fields(strings.ToLower(params["headers"]))
+	if len(headers) == 0 {
+		headers = []string{"date"}
+	}
+
+	// the body is only covered by the signature through the digest
+	signed := make(map[string]bool, len(headers))
+	for _, h := range headers {
+		signed[h] = true
+	}
+	if !signed["(request-target)"] || !signed["digest"] {
+		return "", fmt.Errorf("signature must cover (request-target) and digest")
+	}
+	if err := checkDigest(r.Header.Get("Digest"), body); err != nil {
+		return "", err
+	}
+
+	if date, err := http.ParseTime(r.Header.Get("Date")); err == nil {
+		if skew := time.Since(date); skew > 12*time.Hour || skew < -12*time.Hour {
+			return "", fmt.Errorf("date header is too far off: %s", r.Header.Get("Date"))
+		}
+	} else if signed["date"] {
+		return "", fmt.Errorf("invalid date header: %w", err)
+	}
+
+	lines := make([]string, len(headers))
+	for i, h := range headers {
+		switch h {
+		case "(request-target)":
+			lines[i] = h + ": " + strings.ToLower(r.Method) + " " + r.URL.RequestURI()
+		case "host":
+			lines[i] = h + ": " + r.Host
+		default:
+			lines[i] = h + ": " + strings.Join(r.Header.Values(h), ", ")
+		}
+	}
+	hashed := sha256.Sum256([]byte(strings.Join(lines, "\n")))
+
+	actor, err := litepub.FetchActor(keyId)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch key '%s': %w", keyId, err)
+	}
+	if actor.PublicKey.Id != keyId {
+		return "", fmt.Errorf("key '%s' not found on actor '%s'", keyId, actor.Id)
+	}
+
+	pk, err := parsePublicKeyPEM(actor.PublicKey.PublicKeyPEM)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse key '%s': %w", keyId, err)
+	}
+
+	if err := rsa.VerifyPKCS1v15(pk, crypto.SHA256, hashed[:], signature); err != nil {
+		return "", fmt.Errorf("signature doesn't match: %w", err)
+	}
+
+	// anyone can publish a key saying it belongs to someone else, so unless we got
+	// the key from the owner's own document, the owner must say the key is theirs
+	owner := actor.PublicKey.Owner
+	if owner == "" {
+		owner = actor.Id
+	}
+	if owner != actor.Id || owner != strings.SplitN(keyId, "#", 2)[0] {
+		ownerActor, err := litepub.FetchActor(owner)
+		if err != nil {
+			return "", fmt.Errorf("failed to fetch owner '%s' of key '%s': %w", owner, keyId, err)
+		}
+		if ownerActor.Id != owner || ownerActor.PublicKey.Id != keyId {
+			return "", fmt.Errorf("key '%s' doesn't belong to '%s'", keyId, owner)
+		}
+	}
+
+	return owner, nil
+}
+
+// signedHeaders is what we sign on our POSTs, mastodon wants at least these.
+var signedHeaders = []string{"(request-target)", "host", "date", "digest"}
+
+// postSigned sends an activity to a pub inbox signed with the key of one of our actors.
+func postSigned(key *rsa.PrivateKey, keyId string, inbox string, body []byte) (*http.Response, error) {
+	r, err := http.NewRequest("POST", inbox, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	r.Header.Set("Content-Type", "application/activity+json")
+	r.Header.Set("Accept", "application/activity+json")
+
+	if err := signRequest(r, key, keyId, body); err != nil {
+		return nil, err
+	}
+	return http.DefaultClient.Do(r)
+}
+
+// signRequest adds the Date, Digest and Signature headers to a request.
+func signRequest(r *http.Request, key *rsa.PrivateKey, keyId string, body []byte) error {
+	digest := sha256.Sum256(body)
+	r.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	r.Header.Set("Digest", "SHA-256="+base64.StdEncoding.EncodeToString(digest[:]))
+
+	lines := make([]string, len(signedHeaders))
+	for i, h := range signedHeaders {
+		switch h {
+		case "(request-target)":
+			lines[i] = h + ": " + strings.ToLower(r.Method) + " " + r.URL.RequestURI()
+		case "host":
+			lines[i] = h + ": " + r.URL.Host
+		default:
+			lines[i] = h + ": " + r.Header.Get(h)
+		}
+	}
+	hashed := sha256.Sum256([]byte(strings.Join(lines, "\n")))
+
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hashed[:])
+	if err != nil {
+		return fmt.Errorf("failed to sign request: %w", err)
+	}
+
+	r.Header.Set("Signature", fmt.Sprintf(
+		`keyId="%s",algorithm="rsa-sha256",headers="%s",signature="%s"`,
+		keyId, strings.Join(signedHeaders, " "), base64.StdEncoding.EncodeToString(signature),
+	))
+	return nil
+}
+
+// checkDigest accepts both the standard "SHA-256=<base64>" form and the
+// "SHA2-256=<hex>" form produced by litepub.SendSigned.
+func checkDigest(header string, body []byte) error {
+	digest := sha256.Sum256(body)
+
+	for _, entry := range strings.Split(header, ",") {
+		kv := strings.SplitN(strings.TrimSpace(entry), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+
+		switch strings.ToUpper(kv[0]) {
+		case "SHA-256":
+			if kv[1] == base64.StdEncoding.EncodeToString(digest[:]) {
+				return nil
+			}
+			return fmt.Errorf("digest doesn't match the body")
+		case "SHA2-256":
+			if strings.ToLower(kv[1]) == hex.EncodeToString(digest[:]) {
+				return nil
+			}
+			return fmt.Errorf("digest doesn't match the body")
+		}
+	}
+
+	return fmt.Errorf("missing or unsupported Digest header '%s'", header)
+}
+
+func parsePublicKeyPEM(pemString string) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode([]byte(pemString))
+	if block == nil {
+		return nil, fmt.Errorf("failed to decode PEM public key")
+	}
+
+	if block.Type == "RSA PUBLIC KEY" {
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	pk, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("key is not RSA")
+	}
+	return pk, nil
+}
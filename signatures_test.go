@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// actorServer is a stand-in for the servers of pub actors, it serves whatever
+// documents are put in it.
+type actorServer struct {
+	*httptest.Server
+	docs map[string]any
+}
+
+func newActorServer(t *testing.T) *actorServer {
+	as := &actorServer{docs: make(map[string]any)}
+	as.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		doc, ok := as.docs[r.URL.Path]
+		if !ok {
+			http.Error(w, "not found", 404)
+			return
+		}
+		w.Header().Set("Content-Type", "application/activity+json")
+		json.NewEncoder(w).Encode(doc)
+	}))
+	t.Cleanup(as.Close)
+	return as
+}
+
+// addActor publishes an actor at path with a key that says it belongs to owner.
+func (as *actorServer) addActor(path string, keyId string, owner string, key *rsa.PrivateKey) {
+	der, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	as.docs[path] = map[string]any{
+		"id":   as.URL + path,
+		"type": "Person",
+		"publicKey": map[string]any{
+			"id":           keyId,
+			"owner":        owner,
+			"publicKeyPem": string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})),
+		},
+	}
+}
+
+func newTestKey(t *testing.T) *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// signTestRequest signs an inbox POST the way mastodon does.
+func signTestRequest(t *testing.T, key *rsa.PrivateKey, keyId string, body []byte) *http.Request {
+	r := httptest.NewRequest("POST", "https://bridge.example.com/pub", bytes.NewReader(body))
+
+	digest := sha256.Sum256(body)
+	r.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	r.Header.Set("Digest", "SHA-256="+base64.StdEncoding.EncodeToString(digest[:]))
+
+	payload := "(request-target): post /pub\nhost: " + r.Host +
+		"\ndate: " + r.Header.Get("Date") + "\ndigest: " + r.Header.Get("Digest")
+	hashed := sha256.Sum256([]byte(payload))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hashed[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r.Header.Set("Signature", `keyId="`+keyId+`",algorithm="rsa-sha256",headers="(request-target) host date digest",signature="`+
+		base64.StdEncoding.EncodeToString(signature)+`"`)
+	return r
+}
+
+func TestVerifyRequest(t *testing.T) {
+	as := newActorServer(t)
+	aliceKey := newTestKey(t)
+	attackerKey := newTestKey(t)
+
+	alice := as.URL + "/users/alice"
+	as.addActor("/users/alice", alice+"#main-key", alice, aliceKey)
+
+	// bob's key is in a document of its own, which bob points to
+	bobKey := newTestKey(t)
+	bob := as.URL + "/users/bob"
+	as.addActor("/users/bob", as.URL+"/keys/bob", bob, bobKey)
+	as.addActor("/keys/bob", as.URL+"/keys/bob", bob, bobKey)
+
+	// the attacker says their key belongs to alice
+	as.addActor("/users/attacker", as.URL+"/users/attacker#main-key", alice, attackerKey)
+	// and also publishes a separate key document for her
+	as.addActor("/keys/fake-alice", as.URL+"/keys/fake-alice", alice, attackerKey)
+
+	body := []byte(`{"type":"Follow","actor":"` + alice + `"}`)
+
+	tests := []struct {
+		name    string
+		request func() *http.Request
+		body    []byte // what arrives, if not what was signed
+		owner   string
+		err     string
+	}{
+		{
+			name:    "valid",
+			request: func() *http.Request { return signTestRequest(t, aliceKey, alice+"#main-key", body) },
+			owner:   alice,
+		},
+		{
+			name:    "separate key document",
+			request: func() *http.Request { return signTestRequest(t, bobKey, as.URL+"/keys/bob", body) },
+			owner:   bob,
+		},
+		{
+			name: "key claiming someone else as owner",
+			request: func() *http.Request {
+				return signTestRequest(t, attackerKey, as.URL+"/users/attacker#main-key", body)
+			},
+			err: "doesn't belong to",
+		},
+		{
+			name: "key document the owner doesn't know about",
+			request: func() *http.Request {
+				return signTestRequest(t, attackerKey, as.URL+"/keys/fake-alice", body)
+			},
+			err: "doesn't belong to",
+		},
+		{
+			name:    "signed with another key",
+			request: func() *http.Request { return signTestRequest(t, attackerKey, alice+"#main-key", body) },
+			err:     "signature doesn't match",
+		},
+		{
+			name:    "body changed after signing",
+			request: func() *http.Request { return signTestRequest(t, aliceKey, alice+"#main-key", body) },
+			body:    []byte(`{"type":"Delete","actor":"` + alice + `"}`),
+			err:     "digest doesn't match",
+		},
+		{
+			name: "digest not signed",
+			request: func() *http.Request {
+				r := signTestRequest(t, aliceKey, alice+"#main-key", body)
+				r.Header.Set("Signature", strings.Replace(r.Header.Get("Signature"), " digest", "", 1))
+				return r
+			},
+			err: "must cover",
+		},
+		{
+			name: "unknown key",
+			request: func() *http.Request {
+				return signTestRequest(t, aliceKey, as.URL+"/users/nobody#main-key", body)
+			},
+			err: "failed to fetch key",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := body
+			if test.body != nil {
+				b = test.body
+			}
+
+			owner, err := verifyRequest(test.request(), b)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected error containing %q, got owner %q and error %v", test.err, owner, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if owner != test.owner {
+				t.Fatalf("expected owner %q, got %q", test.owner, owner)
+			}
+		})
+	}
+}
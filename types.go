@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/fiatjaf/litepub"
+	"github.com/tidwall/gjson"
+)
+
+// Activity is a generic activitypub activity, for the types litepub doesn't have
+// or for when we need the "actor" and audience fields litepub doesn't include.
+type Activity struct {
+	litepub.Base
+
+	Actor     string     `json:"actor"`
+	Object    any        `json:"object"`
+	To        []string   `json:"to,omitempty"`
+	CC        []string   `json:"cc,omitempty"`
+	Published *time.Time `json:"published,omitempty"`
+}
+
+// OrderedCollection is like litepub's, but links to its first page instead of
+// embedding it.
+type OrderedCollection struct {
+	litepub.Base
+
+	TotalItems int    `json:"totalItems,omitempty"`
+	First      string `json:"first"`
+}
+
+// OrderedCollectionPage is like litepub's, but can also link to the previous page.
+type OrderedCollectionPage[I any] struct {
+	litepub.Base
+
+	PartOf       string `json:"partOf"`
+	TotalItems   int    `json:"totalItems,omitempty"`
+	OrderedItems []I    `json:"orderedItems"`
+	Next         string `json:"next,omitempty"`
+	Prev         string `json:"prev,omitempty"`
+}
+
+type Tombstone struct {
+	litepub.Base
+
+	FormerType string     `json:"formerType,omitempty"`
+	Deleted    *time.Time `json:"deleted,omitempty"`
+}
+
+// Note is a litepub.Note with the fields litepub doesn't know about.
+type Note struct {
+	litepub.Note
+
+	InReplyTo  string       `json:"inReplyTo,omitempty"`
+	Tag        []Tag        `json:"tag,omitempty"`
+	Attachment []Attachment `json:"attachment,omitempty"`
+	Summary    string       `json:"summary,omitempty"`
+	Sensitive  bool         `json:"sensitive,omitempty"`
+
+	// for polls (type Question) and votes on them
+	Name    string       `json:"name,omitempty"`
+	OneOf   []PollOption `json:"oneOf,omitempty"`
+	AnyOf   []PollOption `json:"anyOf,omitempty"`
+	EndTime *time.Time   `json:"endTime,omitempty"`
+	Closed  any          `json:"closed,omitempty"` // a date, but sometimes just true
+}
+
+// isNote tells if this is something we can bridge as a note, which includes polls.
+func (note Note) isNote() bool {
+	return note.Type == "Note" || note.Type == "Question"
+}
+
+// ReplyTo returns the url of the note this is replying to, some servers only
+// send "inReplyToAtomUri".
+func (note Note) ReplyTo() string {
+	if note.InReplyTo != "" {
+		return note.InReplyTo
+	}
+	return note.Note.InReplyTo
+}
+
+type Tag struct {
+	Type string `json:"type"`
+	Href string `json:"href,omitempty"`
+	Name string `json:"name,omitempty"`
+}
+
+type PollOption struct {
+	Type    string `json:"type"`
+	Name    string `json:"name"`
+	Replies *struct {
+		TotalItems int `json:"totalItems"`
+	} `json:"replies,omitempty"`
+}
+
+func (option PollOption) votes() int {
+	if option.Replies == nil {
+		return 0
+	}
+	return option.Replies.TotalItems
+}
+
+type Attachment struct {
+	Type      string `json:"type"`
+	MediaType string `json:"mediaType,omitempty"`
+	URL       string `json:"url"`
+	Name      string `json:"name,omitempty"`
+	Blurhash  string `json:"blurhash,omitempty"`
+	Width     int    `json:"width,omitempty"`
+	Height    int    `json:"height,omitempty"`
+}
+
+// UnmarshalJSON exists because some servers send "url" as a Link or a list of
+// Links instead of a plain string.
+func (a *Attachment) UnmarshalJSON(b []byte) error {
+	obj := gjson.ParseBytes(b)
+	if !obj.IsObject() {
+		return fmt.Errorf("attachment is not an object: %s", b)
+	}
+
+	a.Type = obj.Get("type").String()
+	a.MediaType = obj.Get("mediaType").String()
+	a.Name = obj.Get("name").String()
+	a.Blurhash = obj.Get("blurhash").String()
+	a.Width = int(obj.Get("width").Int())
+	a.Height = int(obj.Get("height").Int())
+
+	url := obj.Get("url")
+	if url.IsArray() {
+		url = url.Get("0")
+	}
+	if url.IsObject() {
+		if a.MediaType == "" {
+			a.MediaType = url.Get("mediaType").String()
+		}
+		url = url.Get("href")
+	}
+	a.URL = url.String()
+
+	return nil
+}
+
+func wrapCreate(note Note, createId string) litepub.Create[Note] {
+	return litepub.Create[Note]{
+		Base: litepub.Base{
+			Type: "Create",
+			Id:   createId,
+		},
+		Actor:  note.AttributedTo,
+		Object: note,
+	}
+}
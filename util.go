@@ -5,19 +5,86 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"net/url"
 	"strings"
+	"time"
 
 	"github.com/fiatjaf/litepub"
-	strip "github.com/grokify/html-strip-tags-go"
+	"github.com/lib/pq"
 	"github.com/nbd-wtf/go-nostr"
 	"github.com/nbd-wtf/go-nostr/nip10"
+	"github.com/nbd-wtf/go-nostr/nip19"
+	"golang.org/x/exp/slices"
 )
 
+func isHex(s string) bool {
+	for _, c := range s {
+		if !(c >= '0' && c <= '9') && !(c >= 'a' && c <= 'f') && !(c >= 'A' && c <= 'F') {
+			return false
+		}
+	}
+	return true
+}
+
+// decodePubkey accepts a hex pubkey, an npub or an nprofile and returns the hex
+// pubkey along with the relays that came in the nprofile we can use, see relayHints.
+func decodePubkey(code string) (string, []string, bool) {
+	if len(code) == 64 && isHex(code) {
+		return strings.ToLower(code), nil, true
+	}
+
+	prefix, value, err := nip19.Decode(code)
+	if err != nil {
+		return "", nil, false
+	}
+	switch prefix {
+	case "npub":
+		return value.(string), nil, true
+	case "nprofile":
+		profile := value.(nip19.ProfilePointer)
+		return profile.PublicKey, relayHints(profile.Relays), true
+	}
+	return "", nil, false
+}
+
+// decodeEventId is like decodePubkey, but for hex ids, notes and nevents.
+func decodeEventId(code string) (string, []string, bool) {
+	if len(code) == 64 && isHex(code) {
+		return strings.ToLower(code), nil, true
+	}
+
+	prefix, value, err := nip19.Decode(code)
+	if err != nil {
+		return "", nil, false
+	}
+	switch prefix {
+	case "note":
+		return value.(string), nil, true
+	case "nevent":
+		event := value.(nip19.EventPointer)
+		return event.ID, relayHints(event.Relays), true
+	}
+	return "", nil, false
+}
+
 func nostrKeysForPubActor(author string) (string, string) {
-	// create a fake nostr keypair for this author using the server private key as the hmac key
-	sk := hmac.New(sha256.New, s.PrivateKey.D.Bytes()).Sum([]byte(author))
-	privkey := hex.EncodeToString(sk)
+	// reuse the keypair if we have created one before
+	var keys struct {
+		Privkey string `db:"nostr_privkey"`
+		Pubkey  string `db:"nostr_pubkey"`
+	}
+	if err := pg.Get(&keys, `
+        SELECT nostr_privkey, nostr_pubkey FROM keys
+        WHERE pub_actor_url = $1 LIMIT 1
+    `, author); err == nil {
+		return keys.Privkey, keys.Pubkey
+	}
+
+	// create a fake nostr keypair for this author using the server secret as the hmac key
+	mac := hmac.New(sha256.New, []byte(s.Secret))
+	mac.Write([]byte(author))
+	privkey := hex.EncodeToString(mac.Sum(nil))
 	pubkey, _ := nostr.GetPublicKey(privkey)
 	go pg.Exec(`
         INSERT INTO keys (pub_actor_url, nostr_privkey, nostr_pubkey)
@@ -28,23 +95,61 @@ func nostrKeysForPubActor(author string) (string, string) {
 	return privkey, pubkey
 }
 
-func nostrEventFromPubNote(note *litepub.Note) nostr.Event {
+func nostrEventFromPubNote(note *Note) nostr.Event {
 	privkey, pubkey := nostrKeysForPubActor(note.AttributedTo)
 
 	tags := make(nostr.Tags, 0, 2)
 	// "e" tags
-	if note.InReplyTo != "" {
+	if replyTo := note.ReplyTo(); replyTo != "" {
 		var id string
-		if err := pg.Get(&id, "SELECT nostr_event_id FROM notes WHERE pub_note_url = $1", note.InReplyTo); err == nil {
+		if err := pg.Get(&id, "SELECT nostr_event_id FROM notes WHERE pub_note_url = $1", replyTo); err == nil {
 			tags = append(tags, nostr.Tag{"e", id, s.RelayURL})
 		} else {
-			if note, err := litepub.FetchNote(note.InReplyTo); err == nil {
+			if note, err := fetchNote(replyTo); err == nil {
 				evt := nostrEventFromPubNote(note) // @warn will recurse until the start of the thread
 				tags = append(tags, nostr.Tag{"e", evt.ID, s.RelayURL})
 			}
 		}
 	}
 
+	content, mentioned := nostrContentFromHTML(note.Content, note.Tag)
+
+	// polls have their options listed after the question, the NIP-88 poll is
+	// made separately by nostrPollEventFromPub
+	if options, _ := note.pollOptions(); len(options) > 0 {
+		content = strings.TrimSpace(content) + "\n\n" + pollLines(options)
+	}
+
+	// media goes at the end of the content, described by imeta tags
+	mediaUrls, mediaTags := nostrMediaFromPub(note.Attachment)
+	for _, url := range mediaUrls {
+		if !strings.Contains(content, url) {
+			content += "\n\n" + url
+		}
+	}
+	content = strings.TrimSpace(content)
+	tags = append(tags, mediaTags...)
+
+	// hashtags
+	hashtags := make(map[string]bool)
+	for _, tag := range note.Tag {
+		if tag.Type != "Hashtag" {
+			continue
+		}
+		name := strings.ToLower(strings.TrimPrefix(tag.Name, "#"))
+		if name != "" && !hashtags[name] {
+			hashtags[name] = true
+			tags = append(tags, nostr.Tag{"t", name})
+		}
+	}
+
+	// NIP-36
+	if note.Summary != "" {
+		tags = append(tags, nostr.Tag{"content-warning", note.Summary})
+	} else if note.Sensitive {
+		tags = append(tags, nostr.Tag{"content-warning"})
+	}
+
 	// "p" tags
 	for _, a := range append(note.CC, note.To...) {
 		if strings.HasSuffix(a, "/followers") || strings.HasSuffix(a, "https://www.w3.org/ns/activitystreams#Public") {
@@ -52,6 +157,14 @@ func nostrEventFromPubNote(note *litepub.Note) nostr.Event {
 		}
 
 		_, pk := nostrKeysForPubActor(a)
+		mentioned = append(mentioned, pk)
+	}
+	seen := make(map[string]bool, len(mentioned))
+	for _, pk := range mentioned {
+		if seen[pk] {
+			continue
+		}
+		seen[pk] = true
 		tags = append(tags, nostr.Tag{"p", pk, s.RelayURL})
 	}
 
@@ -60,7 +173,7 @@ func nostrEventFromPubNote(note *litepub.Note) nostr.Event {
 		PubKey:    pubkey,
 		Tags:      tags,
 		Kind:      1,
-		Content:   strip.StripTags(note.Content),
+		Content:   content,
 	}
 
 	if err := evt.Sign(privkey); err != nil {
@@ -76,7 +189,125 @@ func nostrEventFromPubNote(note *litepub.Note) nostr.Event {
 	return evt
 }
 
-func nostrEventFromActorMetadata(actor *litepub.Actor) nostr.Event {
+// nostrEventIdForPubObject finds the nostr event behind a pub object, which is
+// either one of our notes or something we've bridged before.
+func nostrEventIdForPubObject(objectUrl string) (string, bool) {
+	if id := strings.TrimPrefix(objectUrl, s.ServiceURL+"/pub/note/"); id != objectUrl {
+		return id, len(id) == 64 && isHex(id)
+	}
+
+	var id string
+	if err := pg.Get(&id, "SELECT nostr_event_id FROM notes WHERE pub_note_url = $1", objectUrl); err == nil {
+		return id, true
+	}
+	return "", false
+}
+
+func nostrEventFromPubLike(actor string, likeId string, objectUrl string, published time.Time) (nostr.Event, error) {
+	target, ok := nostrEventIdForPubObject(objectUrl)
+	if !ok {
+		return nostr.Event{}, fmt.Errorf("liked object '%s' is unknown", objectUrl)
+	}
+
+	privkey, pubkey := nostrKeysForPubActor(actor)
+
+	tags := nostr.Tags{{"e", target, s.RelayURL}}
+	if liked := findEvent(target); liked != nil {
+		tags = append(tags, nostr.Tag{"p", liked.PubKey, s.RelayURL})
+	}
+
+	if published.IsZero() {
+		published = time.Now()
+	}
+
+	evt := nostr.Event{
+		CreatedAt: published,
+		PubKey:    pubkey,
+		Tags:      tags,
+		Kind:      7,
+		Content:   "+",
+	}
+
+	if err := evt.Sign(privkey); err != nil {
+		return evt, fmt.Errorf("failed to sign reaction: %w", err)
+	}
+
+	// so we can find it later when it's undone
+	go pg.Exec(`
+        INSERT INTO notes (pub_note_url, nostr_event_id)
+        VALUES ($1, $2)
+        ON CONFLICT DO NOTHING
+    `, likeId, evt.ID)
+
+	return evt, nil
+}
+
+func nostrEventFromPubAnnounce(actor string, announceId string, reposted nostr.Event, published time.Time) nostr.Event {
+	privkey, pubkey := nostrKeysForPubActor(actor)
+
+	if published.IsZero() {
+		published = time.Now()
+	}
+
+	jreposted, _ := json.Marshal(reposted)
+
+	evt := nostr.Event{
+		CreatedAt: published,
+		PubKey:    pubkey,
+		Tags: nostr.Tags{
+			{"e", reposted.ID, s.RelayURL},
+			{"p", reposted.PubKey, s.RelayURL},
+		},
+		Kind:    6,
+		Content: string(jreposted),
+	}
+
+	if err := evt.Sign(privkey); err != nil {
+		log.Warn().Err(err).Interface("evt", evt).Msg("fail to sign an event")
+	}
+
+	// so we can find it later when it's undone
+	go pg.Exec(`
+        INSERT INTO notes (pub_note_url, nostr_event_id)
+        VALUES ($1, $2)
+        ON CONFLICT DO NOTHING
+    `, announceId, evt.ID)
+
+	return evt
+}
+
+// nostrDeletionFromPub creates a deletion event for something that was bridged
+// from pub and is now gone.
+func nostrDeletionFromPub(actor string, objectUrl string) (nostr.Event, error) {
+	var id string
+	if err := pg.Get(&id, "SELECT nostr_event_id FROM notes WHERE pub_note_url = $1", objectUrl); err != nil {
+		return nostr.Event{}, fmt.Errorf("deleted object '%s' is unknown", objectUrl)
+	}
+
+	privkey, pubkey := nostrKeysForPubActor(actor)
+
+	// anyone can send a Delete for anything
+	if deleted := findEvent(id); deleted == nil || deleted.PubKey != pubkey {
+		return nostr.Event{}, fmt.Errorf("deleted object '%s' isn't from '%s'", objectUrl, actor)
+	}
+
+	evt := nostr.Event{
+		CreatedAt: time.Now(),
+		PubKey:    pubkey,
+		Tags:      nostr.Tags{{"e", id}},
+		Kind:      5,
+	}
+
+	if err := evt.Sign(privkey); err != nil {
+		return evt, fmt.Errorf("failed to sign deletion: %w", err)
+	}
+
+	return evt, nil
+}
+
+// nostrEventFromActorMetadata creates a kind-0 for a pub actor, updatedAt should
+// be newer than the last time we did this for the same actor if anything changed.
+func nostrEventFromActorMetadata(actor *litepub.Actor, updatedAt time.Time) nostr.Event {
 	privkey, pubkey := nostrKeysForPubActor(actor.Id)
 
 	name := actor.Name
@@ -98,7 +329,7 @@ func nostrEventFromActorMetadata(actor *litepub.Actor) nostr.Event {
 	})
 
 	evt := nostr.Event{
-		CreatedAt: actor.Published,
+		CreatedAt: updatedAt,
 		PubKey:    pubkey,
 		Tags:      make(nostr.Tags, 0),
 		Kind:      0,
@@ -143,35 +374,263 @@ func nostrEventFromActorFollows(actor *litepub.Actor) nostr.Event {
 	return evt
 }
 
-func pubNoteFromNostrEvent(event nostr.Event) litepub.Note {
-	pTags := event.Tags.GetAll([]string{"p", ""})
-	cc := make([]string, len(pTags))
-	for i, tag := range pTags {
-		cc[i] = s.ServiceURL + "/pub/user/" + tag.Value()
+func pubNoteFromNostrEvent(event nostr.Event) Note {
+	// everybody mentioned, which should include the author of the note we're
+	// replying to, but we make sure of that
+	mentioned := make([]string, 0, len(event.Tags))
+	for _, tag := range event.Tags.GetAll([]string{"p", ""}) {
+		if !slices.Contains(mentioned, tag.Value()) {
+			mentioned = append(mentioned, tag.Value())
+		}
 	}
 
 	inReplyTo := ""
 	if replyTag := nip10.GetImmediateReply(event.Tags); replyTag != nil {
-		inReplyTo = s.ServiceURL + "/pub/note/" + replyTag.Value()
+		inReplyTo = pubNoteURL(replyTag.Value())
+
+		var author string
+		if err := pg.Get(&author, "SELECT pubkey FROM events WHERE id = $1", replyTag.Value()); err == nil {
+			if author != event.PubKey && !slices.Contains(mentioned, author) {
+				mentioned = append(mentioned, author)
+			}
+		}
+	}
+
+	content, contentTags := htmlContentFromNostr(event)
+	for _, tag := range event.Tags.GetAll([]string{"t", ""}) {
+		contentTags = append(contentTags, pubHashtag(tag.Value()))
+	}
+
+	cc := make([]string, len(mentioned), len(mentioned)+1)
+	tags := make([]Tag, len(mentioned))
+	for i, pubkey := range mentioned {
+		tags[i] = pubMention(pubkey)
+		cc[i] = tags[i].Href
+	}
+	for _, tag := range contentTags {
+		if slices.IndexFunc(tags, func(t Tag) bool { return t.Href == tag.Href }) != -1 {
+			continue
+		}
+		tags = append(tags, tag)
+		if tag.Type == "Mention" {
+			cc = append(cc, tag.Href)
+		}
+	}
+	cc = append(cc, s.ServiceURL+"/pub/user/"+event.PubKey+"/followers")
+
+	note := Note{
+		Note: litepub.Note{
+			Base: litepub.Base{
+				Id:   s.ServiceURL + "/pub/note/" + event.ID,
+				Type: "Note",
+			},
+			Published:    event.CreatedAt,
+			AttributedTo: s.ServiceURL + "/pub/user/" + event.PubKey,
+			Content:      content,
+			InReplyTo:    inReplyTo,
+			To:           []string{"https://www.w3.org/ns/activitystreams#Public"},
+			CC:           cc,
+		},
+		InReplyTo:  inReplyTo,
+		Tag:        tags,
+		Attachment: pubAttachmentsFromNostr(event),
+	}
+
+	// NIP-36, mastodon only hides the content if there is a summary
+	if cw := event.Tags.GetFirst([]string{"content-warning"}); cw != nil {
+		note.Sensitive = true
+		note.Summary = "Content warning"
+		if len(*cw) > 1 && (*cw)[1] != "" {
+			note.Summary = (*cw)[1]
+		}
+	}
+
+	return note
+}
+
+// pubActivityFromNostrEvent returns what should go in an outbox for each event.
+func pubActivityFromNostrEvent(event nostr.Event) (any, bool) {
+	switch event.Kind {
+	case 1:
+		note := pubNoteFromNostrEvent(event)
+		return wrapCreate(note, s.ServiceURL+"/pub/create/"+event.ID), true
+	case 6:
+		return pubAnnounceFromNostrEvent(event)
+	}
+	return nil, false
+}
+
+// pubAnnounceFromNostrEvent turns a repost into an Announce of the original note,
+// which may be one of ours or a note that came from pub.
+func pubAnnounceFromNostrEvent(event nostr.Event) (Activity, bool) {
+	target := event.Tags.GetLast([]string{"e", ""})
+	if target == nil {
+		return Activity{}, false
+	}
+
+	cc := []string{s.ServiceURL + "/pub/user/" + event.PubKey + "/followers"}
+
+	// the reposted event is supposed to be in the content, but it's not always there
+	var reposted nostr.Event
+	if err := json.Unmarshal([]byte(event.Content), &reposted); err != nil || reposted.ID != target.Value() {
+		if found := findEvent(target.Value()); found != nil {
+			reposted = *found
+		}
+	}
+	if reposted.PubKey != "" {
+		author, _ := pubActorURL(reposted.PubKey)
+		cc = append(cc, author)
+	}
+
+	published := event.CreatedAt
+	return Activity{
+		Base: litepub.Base{
+			Type: "Announce",
+			Id:   s.ServiceURL + "/pub/announce/" + event.ID,
+		},
+		Actor:     s.ServiceURL + "/pub/user/" + event.PubKey,
+		Object:    pubNoteURL(target.Value()),
+		To:        []string{"https://www.w3.org/ns/activitystreams#Public"},
+		CC:        cc,
+		Published: &published,
+	}, true
+}
+
+// pubLikeFromNostrEvent turns a reaction to a note that came from pub into a Like,
+// returns also the actor who should receive it.
+func pubLikeFromNostrEvent(event nostr.Event) (Activity, string, bool) {
+	if event.Content != "+" && event.Content != "" {
+		return Activity{}, "", false
+	}
+
+	target := event.Tags.GetLast([]string{"e", ""})
+	if target == nil {
+		return Activity{}, "", false
+	}
+
+	var noteUrl string
+	if err := pg.Get(&noteUrl, "SELECT pub_note_url FROM notes WHERE nostr_event_id = $1", target.Value()); err != nil {
+		return Activity{}, "", false
+	}
+
+	author := pubNoteAuthor(target.Value(), noteUrl)
+	if author == "" {
+		return Activity{}, "", false
 	}
 
-	return litepub.Note{
+	return Activity{
 		Base: litepub.Base{
-			Id:   s.ServiceURL + "/pub/note/" + event.ID,
-			Type: "Note",
+			Type: "Like",
+			Id:   s.ServiceURL + "/pub/like/" + event.ID,
 		},
-		Published:    event.CreatedAt,
-		AttributedTo: s.ServiceURL + "/pub/user/" + event.PubKey,
-		Content:      event.Content,
-		InReplyTo:    inReplyTo,
-		To:           []string{"https://www.w3.org/ns/activitystreams#Public"},
-		CC:           cc,
+		Actor:  s.ServiceURL + "/pub/user/" + event.PubKey,
+		Object: noteUrl,
+		To:     []string{author},
+	}, author, true
+}
+
+// pubNoteAuthor finds the original author of a note that came from pub.
+func pubNoteAuthor(id string, noteUrl string) string {
+	var author string
+	if err := pg.Get(&author, `
+        SELECT keys.pub_actor_url FROM events
+        INNER JOIN keys ON keys.nostr_pubkey = events.pubkey
+        WHERE events.id = $1
+    `, id); err == nil {
+		return author
+	}
+
+	if note, err := fetchNote(noteUrl); err == nil {
+		return note.AttributedTo
 	}
+	return ""
+}
+
+// pubActorURL returns the original actor for pubkeys we've created for pub actors
+// or our own actor for nostr-native pubkeys.
+func pubActorURL(pubkey string) (string, bool) {
+	var actorUrl string
+	if err := pg.Get(&actorUrl, "SELECT pub_actor_url FROM keys WHERE nostr_pubkey = $1", pubkey); err == nil {
+		return actorUrl, true
+	}
+	return s.ServiceURL + "/pub/user/" + pubkey, false
+}
+
+// bridgedPubkeys tells which of these pubkeys stand for pub actors.
+func bridgedPubkeys(pubkeys []string) map[string]bool {
+	var found []string
+	if err := pg.Select(&found, `
+        SELECT nostr_pubkey FROM keys WHERE nostr_pubkey = ANY($1)
+    `, pq.StringArray(pubkeys)); err != nil {
+		log.Warn().Err(err).Msg("failed to check for bridged pubkeys")
+	}
+
+	bridged := make(map[string]bool, len(found))
+	for _, pubkey := range found {
+		bridged[pubkey] = true
+	}
+	return bridged
+}
+
+// pubNoteURL is like pubActorURL, but for notes.
+func pubNoteURL(id string) string {
+	var noteUrl string
+	if err := pg.Get(&noteUrl, "SELECT pub_note_url FROM notes WHERE nostr_event_id = $1", id); err == nil {
+		return noteUrl
+	}
+	return s.ServiceURL + "/pub/note/" + id
+}
+
+func pubMention(pubkey string) Tag {
+	actorUrl, bridged := pubActorURL(pubkey)
+	mention := Tag{
+		Type: "Mention",
+		Href: actorUrl,
+		Name: "@" + localUsername(pubkey) + "@" + serviceHost(),
+	}
+
+	if bridged {
+		mention.Name = "@" + pubHandle(pubkey, actorUrl)
+	}
+
+	return mention
+}
+
+// pubHandle is the user@host of a bridged pub actor, without fetching anything as
+// this is used when rendering notes. the kind-0 we made for them has it as nip05.
+func pubHandle(pubkey string, actorUrl string) string {
+	if metadata := storedMetadata(pubkey); metadata != nil && strings.Contains(metadata.NIP05, "@") {
+		return metadata.NIP05
+	}
+	return handleFromActorURL(actorUrl)
+}
+
+// handleFromActorURL guesses user@host from urls like https://host/users/user or
+// https://host/@user, which is what most servers use.
+func handleFromActorURL(actorUrl string) string {
+	parsed, err := url.Parse(actorUrl)
+	if err != nil {
+		return actorUrl
+	}
+	path := strings.Split(strings.TrimSuffix(parsed.Path, "/"), "/")
+	return strings.TrimPrefix(path[len(path)-1], "@") + "@" + parsed.Hostname()
+}
+
+func serviceHost() string {
+	if parsed, err := url.Parse(s.ServiceURL); err == nil {
+		return parsed.Host
+	}
+	return s.ServiceURL
 }
 
 func pubActorFromNostrEvent(event nostr.Event) litepub.Actor {
 	metadata, _ := nostr.ParseMetadata(event)
 
+	publicKeyPEM, err := actorPublicKeyPEM(event.PubKey)
+	if err != nil {
+		log.Error().Err(err).Str("pubkey", event.PubKey).Msg("failed to get actor key")
+	}
+
 	return litepub.Actor{
 		Base: litepub.Base{
 			Id:   s.ServiceURL + "/pub/user/" + event.PubKey,
@@ -184,7 +643,7 @@ func pubActorFromNostrEvent(event nostr.Event) litepub.Actor {
 		Following:                 s.ServiceURL + "/pub/user/" + event.PubKey + "/following",
 		Inbox:                     s.ServiceURL + "/pub",
 		Outbox:                    s.ServiceURL + "/pub/user/" + event.PubKey + "/outbox",
-		PreferredUsername:         event.PubKey,
+		PreferredUsername:         localUsername(event.PubKey),
 		Name:                      metadata.Name,
 		Summary:                   metadata.About,
 		Icon: litepub.ActorImage{
@@ -194,7 +653,7 @@ func pubActorFromNostrEvent(event nostr.Event) litepub.Actor {
 		PublicKey: litepub.PublicKey{
 			Id:           s.ServiceURL + "/pub/user/" + event.PubKey + "#main-key",
 			Owner:        s.ServiceURL + "/pub/user/" + event.PubKey,
-			PublicKeyPEM: s.PublicKeyPEM,
+			PublicKeyPEM: publicKeyPEM,
 		},
 	}
 }
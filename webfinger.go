@@ -3,10 +3,25 @@ package main
 import (
 	"encoding/json"
 	"net/http"
+	"strings"
 
 	"github.com/fiatjaf/litepub"
+	"github.com/nbd-wtf/go-nostr/nip05"
 )
 
+// webfingerResponse is like litepub's, but with aliases.
+type webfingerResponse struct {
+	Subject string          `json:"subject"`
+	Aliases []string        `json:"aliases,omitempty"`
+	Links   []webfingerLink `json:"links"`
+}
+
+type webfingerLink struct {
+	Rel  string `json:"rel"`
+	Type string `json:"type,omitempty"`
+	Href string `json:"href"`
+}
+
 func webfinger(w http.ResponseWriter, r *http.Request) {
 	name, err := litepub.HandleWebfingerRequest(r)
 	if err != nil {
@@ -16,14 +31,48 @@ func webfinger(w http.ResponseWriter, r *http.Request) {
 
 	log.Debug().Str("name", name).Msg("got webfinger request")
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(litepub.WebfingerResponse{
-		Subject: r.URL.Query().Get("resource"),
-		Links: []litepub.WebfingerLink{
+	resource := r.URL.Query().Get("resource")
+	if host := resource[strings.LastIndex(resource, "@")+1:]; host != serviceHost() {
+		http.Error(w, "we don't know about "+host, 404)
+		return
+	}
+
+	// npubs and nprofiles are also accepted, and so are the names registered
+	// with us and nip05 names in the form 'fulano_at_nostr.example.com'
+	pubkey, relays, ok := decodePubkey(name)
+	if !ok {
+		if spl := strings.Split(name, "_at_"); len(spl) == 2 {
+			pubkey = nip05.QueryIdentifier(spl[0] + "@" + spl[1])
+		} else {
+			pubkey, _ = pubkeyForName(name)
+		}
+		if pubkey == "" {
+			http.Error(w, "invalid name "+name, 404)
+			return
+		}
+	}
+
+	if findMetadata(pubkey, relays...) == nil {
+		http.Error(w, "user not found", 404)
+		return
+	}
+
+	actorUrl := s.ServiceURL + "/pub/user/" + pubkey
+
+	w.Header().Set("Content-Type", "application/jrd+json")
+	json.NewEncoder(w).Encode(webfingerResponse{
+		Subject: resource,
+		Aliases: []string{actorUrl, s.ServiceURL + "/" + pubkey},
+		Links: []webfingerLink{
 			{
 				Rel:  "self",
 				Type: "application/activity+json",
-				Href: s.ServiceURL + "/pub/user/" + name,
+				Href: actorUrl,
+			},
+			{
+				Rel:  "http://webfinger.net/rel/profile-page",
+				Type: "text/html",
+				Href: actorUrl,
 			},
 		},
 	})